@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/tztsai/openai-telegram/src/openai"
+)
+
+// DOCUMENT_TIMEOUT bounds the conversion and indexing of a document.
+const DOCUMENT_TIMEOUT = 5 * time.Minute
+
+// attach downloads the document of a message and attaches it to a
+// conversation.
+func (h *Handler) attach(m *tgbotapi.Message, convoID int64) (openai.Document, error) {
+	path, err := h.bot.Download(m.Document.FileID)
+	if err != nil {
+		return openai.Document{}, err
+	}
+	defer os.Remove(path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DOCUMENT_TIMEOUT)
+	defer cancel()
+	return h.gpt.AddDocument(ctx, convoID, path, m.Document.FileName)
+}
@@ -25,6 +25,7 @@ require (
 	github.com/spf13/viper v1.14.0
 	github.com/stretchr/testify v1.8.1
 	github.com/subosito/gotenv v1.4.1
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/net v0.8.0
 	golang.org/x/sys v0.6.0
 	golang.org/x/text v0.8.0
@@ -34,7 +35,6 @@ require (
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	github.com/PuerkitoBio/goquery v1.8.1 // indirect
-	github.com/andybalholm/cascadia v1.3.1 // indirect
-)
+require github.com/PuerkitoBio/goquery v1.8.1
+
+require github.com/andybalholm/cascadia v1.3.1 // indirect
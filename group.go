@@ -0,0 +1,94 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func isGroup(chat *tgbotapi.Chat) bool {
+	return chat.IsGroup() || chat.IsSuperGroup()
+}
+
+// mentionPattern matches the mentions of a username.
+func mentionPattern(username string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)@` + regexp.QuoteMeta(username) + `\b`)
+}
+
+// addressed reports whether a message is meant for the bot: in a group, the
+// bot only answers the replies to its messages, the messages mentioning it
+// and the commands suffixed with its username.
+func (h *Handler) addressed(m *tgbotapi.Message) bool {
+	if !isGroup(m.Chat) {
+		return true
+	}
+	if r := m.ReplyToMessage; r != nil && r.From != nil && r.From.ID == h.bot.ID {
+		return true
+	}
+	if m.IsCommand() {
+		_, bot, _ := strings.Cut(m.CommandWithAt(), "@")
+		return strings.EqualFold(bot, h.bot.Username)
+	}
+	for _, e := range append(m.Entities, m.CaptionEntities...) {
+		if e.Type == "text_mention" && e.User != nil && e.User.ID == h.bot.ID {
+			return true
+		}
+	}
+	return h.mention.MatchString(m.Text) || h.mention.MatchString(m.Caption)
+}
+
+// conversationID returns the key of the conversation of a message: its chat,
+// or with GROUP_THREADS, its thread in a group, which is the reply chain or
+// the forum topic it belongs to. A message out of any thread starts one if
+// create is set, and belongs to the conversation of the group otherwise, so
+// that commands don't create threads.
+func (h *Handler) conversationID(m *tgbotapi.Message, create bool) int64 {
+	if !h.config.GroupThreads || !isGroup(m.Chat) {
+		return m.Chat.ID
+	}
+	// in a forum topic, the messages which are not replies reply to the
+	// message creating the topic
+	root := m.MessageID
+	if m.ReplyToMessage != nil {
+		root = m.ReplyToMessage.MessageID
+	}
+	id, ok := h.gpt.Conversations.FindThread(m.Chat.ID, root)
+	if !ok && !create {
+		return m.Chat.ID
+	} else if !ok {
+		id = h.gpt.Conversations.Thread(m.Chat.ID, root)
+	}
+	if root != m.MessageID {
+		h.gpt.AddToThread(id, m.MessageID)
+	}
+	return id
+}
+
+// reply sends a message of the bot in the conversation of a chat, adding it
+// to the thread of the conversation so that the replies to it stay in it.
+func (h *Handler) reply(chatID, convoID int64, replyTo int, text string) error {
+	msg, err := h.bot.Send(chatID, replyTo, text)
+	if err == nil && convoID != chatID {
+		h.gpt.AddToThread(convoID, msg.MessageID)
+	}
+	return err
+}
+
+// userTurn returns the text of a message as a turn of the conversation. In
+// a group, the mentions of the bot are removed and the text is prefixed with
+// the name of its sender, except plugin commands.
+func (h *Handler) userTurn(m *tgbotapi.Message, text string) string {
+	if !isGroup(m.Chat) {
+		return text
+	}
+	text = strings.TrimSpace(h.mention.ReplaceAllString(text, ""))
+	if strings.HasPrefix(text, "!") || m.From == nil {
+		return text
+	}
+	name := strings.TrimSpace(m.From.FirstName + " " + m.From.LastName)
+	if name == "" {
+		name = m.From.UserName
+	}
+	return name + ": " + text
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/tztsai/openai-telegram/src/config"
+	"github.com/tztsai/openai-telegram/src/openai"
+	"github.com/tztsai/openai-telegram/src/plugin"
+	"github.com/tztsai/openai-telegram/src/speech"
+	"github.com/tztsai/openai-telegram/src/sse"
+	"github.com/tztsai/openai-telegram/src/tgbot"
+)
+
+// STOP_DATA is the callback data of the button stopping an answer.
+const STOP_DATA = "stop"
+
+var STOP_BUTTON = tgbotapi.NewInlineKeyboardButtonData("⏹ Stop", STOP_DATA)
+
+// Callback data of the buttons of the last answer of a conversation.
+const (
+	REGENERATE_DATA = "regenerate"
+	CONTINUE_DATA   = "continue"
+	DELETE_DATA     = "delete"
+)
+
+var ANSWER_BUTTONS = []tgbotapi.InlineKeyboardButton{
+	tgbotapi.NewInlineKeyboardButtonData("🔄 Regenerate", REGENERATE_DATA),
+	tgbotapi.NewInlineKeyboardButtonData("➡️ Continue", CONTINUE_DATA),
+	tgbotapi.NewInlineKeyboardButtonData("🗑 Delete", DELETE_DATA),
+}
+
+// answer is the last answer of a conversation, which has the answer
+// buttons.
+type answer struct {
+	chatID   int64
+	replyTo  int   // ID of the message answered
+	messages []int // IDs of the messages of the answer
+}
+
+// Handler handles the Telegram updates. Updates of the same chat must be
+// handled sequentially, while different chats may be handled in parallel.
+type Handler struct {
+	gpt        *openai.GPT4
+	bot        *tgbot.Bot
+	config     *config.EnvConfig
+	background string
+	mention    *regexp.Regexp // mentions of the bot
+	stt        speech.Transcriber
+	tts        speech.Synthesizer
+
+	mu      sync.Mutex
+	cancels map[int64]context.CancelFunc // stop the answer of each chat
+	answers map[int64]answer             // last answer of each conversation
+}
+
+func NewHandler(gpt *openai.GPT4, bot *tgbot.Bot, config *config.EnvConfig) *Handler {
+	return &Handler{
+		gpt:        gpt,
+		bot:        bot,
+		config:     config,
+		background: Background(gpt),
+		mention:    mentionPattern(bot.Username),
+		stt:        speech.InitTranscriber(config),
+		tts:        speech.InitSynthesizer(config),
+		cancels:    make(map[int64]context.CancelFunc),
+		answers:    make(map[int64]answer),
+	}
+}
+
+// HandleInterrupt handles the updates that must not wait for the previous
+// updates of their chat: /stop and the Stop button. It returns false if the
+// update is to be handled by HandleUpdate.
+func (h *Handler) HandleInterrupt(update tgbotapi.Update) bool {
+	var chatID, userID int64
+	if q := update.CallbackQuery; q != nil && q.Data == STOP_DATA && q.Message != nil {
+		chatID, userID = q.Message.Chat.ID, q.From.ID
+	} else if m := update.Message; m != nil && m.Command() == "stop" && h.addressed(m) {
+		chatID, userID = m.Chat.ID, m.From.ID
+	} else {
+		return false
+	}
+
+	if len(h.config.TelegramID) != 0 && !h.config.AllowTelegramID(userID) {
+		return update.CallbackQuery != nil // messages are refused by HandleUpdate
+	}
+
+	stopped := h.Stop(chatID)
+	if q := update.CallbackQuery; q != nil {
+		if stopped {
+			h.bot.AnswerCallback(q.ID, "Stopping...")
+		} else {
+			h.bot.AnswerCallback(q.ID, "Nothing to stop.")
+		}
+	} else if !stopped {
+		h.bot.Send(chatID, update.Message.MessageID, "ℹ️ Nothing to stop.")
+	}
+	return true
+}
+
+// Stop cancels the answer being generated in a chat. It returns false if
+// there is none.
+func (h *Handler) Stop(chatID int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cancel, ok := h.cancels[chatID]
+	if ok {
+		cancel()
+		delete(h.cancels, chatID)
+	}
+	return ok
+}
+
+// startAnswer returns the context of a new answer in a chat, cancelled by
+// Stop or the returned function.
+func (h *Handler) startAnswer(chatID int64) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.mu.Lock()
+	h.cancels[chatID] = cancel
+	h.mu.Unlock()
+	return ctx, func() {
+		h.mu.Lock()
+		delete(h.cancels, chatID)
+		h.mu.Unlock()
+		cancel()
+	}
+}
+
+// answer sends the answer generated by respond to a chat, which can be
+// stopped with the Stop button. It returns the IDs of the messages sent.
+func (h *Handler) answer(chatID, convoID int64, replyTo int, admin bool,
+	respond func(ctx context.Context) (chan sse.Chunk, error)) []int {
+	h.bot.SendTyping(chatID)
+
+	ctx, done := h.startAnswer(chatID)
+	defer done()
+	ctx = plugin.WithAdmin(ctx, admin)
+	feed, err := respond(ctx)
+
+	var sent []int
+	if err != nil {
+		h.reply(chatID, convoID, replyTo, fmt.Sprintf("❌ %v", err))
+	} else if feed != nil {
+		sent = h.bot.SendAsLiveOutput(chatID, replyTo, feed, STOP_BUTTON)
+		if convoID != chatID {
+			h.gpt.AddToThread(convoID, sent...)
+		}
+	}
+	return sent
+}
+
+// prompt adds the default system prompt to a conversation without messages.
+func (h *Handler) prompt(convoID int64) {
+	if len(h.gpt.GetConversation(convoID).Messages) == 0 {
+		h.gpt.AddMessage(convoID, h.background, "system", 0)
+		log.Println("Added default system prompt")
+	}
+}
+
+// setLastAnswer moves the answer buttons of a conversation to its new last
+// answer.
+func (h *Handler) setLastAnswer(convoID int64, a answer) {
+	h.mu.Lock()
+	last, ok := h.answers[convoID]
+	h.answers[convoID] = a
+	h.mu.Unlock()
+	if ok && len(last.messages) > 0 {
+		h.bot.SetButtons(last.chatID, last.messages[len(last.messages)-1])
+	}
+	if len(a.messages) > 0 {
+		h.bot.SetButtons(a.chatID, a.messages[len(a.messages)-1], ANSWER_BUTTONS...)
+	}
+}
+
+// finishAnswer makes a new answer the last answer of a conversation, and
+// reads it aloud in the voice mode.
+func (h *Handler) finishAnswer(convoID int64, a answer) {
+	h.setLastAnswer(convoID, a)
+	h.speak(convoID, a)
+}
+
+func (h *Handler) forgetAnswer(convoID int64) {
+	h.mu.Lock()
+	delete(h.answers, convoID)
+	h.mu.Unlock()
+}
+
+// HandleCallback handles the buttons of the last answer of a conversation.
+func (h *Handler) HandleCallback(q *tgbotapi.CallbackQuery) {
+	chatID, messageID := q.Message.Chat.ID, q.Message.MessageID
+	if len(h.config.TelegramID) != 0 && !h.config.AllowTelegramID(q.From.ID) {
+		h.bot.AnswerCallback(q.ID, "You are not allowed to use this bot.")
+		return
+	}
+
+	var convoID int64
+	var last answer
+	h.mu.Lock()
+	for id, a := range h.answers {
+		if a.chatID == chatID && len(a.messages) > 0 && a.messages[len(a.messages)-1] == messageID {
+			convoID, last = id, a
+		}
+	}
+	h.mu.Unlock()
+	if last.messages == nil {
+		h.bot.AnswerCallback(q.ID, "Only the last answer can be changed.")
+		h.bot.SetButtons(chatID, messageID)
+		return
+	}
+
+	admin := h.config.IsAdmin(q.From.ID)
+	switch q.Data {
+	case REGENERATE_DATA:
+		h.bot.AnswerCallback(q.ID, "Regenerating...")
+		h.bot.Delete(chatID, last.messages...)
+		h.forgetAnswer(convoID)
+		sent := h.answer(chatID, convoID, last.replyTo, admin, func(ctx context.Context) (chan sse.Chunk, error) {
+			return h.gpt.Regenerate(ctx, convoID)
+		})
+		h.finishAnswer(convoID, answer{chatID, last.replyTo, sent})
+	case CONTINUE_DATA:
+		h.bot.AnswerCallback(q.ID, "Continuing...")
+		sent := h.answer(chatID, convoID, messageID, admin, func(ctx context.Context) (chan sse.Chunk, error) {
+			return h.gpt.Continue(ctx, convoID)
+		})
+		h.finishAnswer(convoID, answer{chatID, messageID, sent})
+	case DELETE_DATA:
+		if h.gpt.DeleteExchange(convoID) {
+			h.bot.AnswerCallback(q.ID, "Deleted from the conversation.")
+		} else {
+			h.bot.AnswerCallback(q.ID, "Nothing to delete.")
+		}
+		h.bot.Delete(chatID, last.messages...)
+		h.forgetAnswer(convoID)
+	default:
+		h.bot.AnswerCallback(q.ID, "Unknown action.")
+	}
+}
+
+// HandleUpdate handles a message or a button press. Messages are ignored in
+// a group unless they are addressed to the bot.
+func (h *Handler) HandleUpdate(update tgbotapi.Update) {
+	if update.Message == nil {
+		h.HandleCallback(update.CallbackQuery)
+		return
+	}
+	if !h.addressed(update.Message) {
+		return
+	}
+	var (
+		updateText      = update.Message.Text
+		updateChatID    = update.Message.Chat.ID
+		updateMessageID = update.Message.MessageID
+		updateUserID    = update.Message.From.ID
+		cmd             = update.Message.Command()
+		args            = strings.TrimSpace(update.Message.CommandArguments())
+	)
+
+	// checked before creating a conversation, so that the refused users don't
+	// fill the database
+	if len(h.config.TelegramID) != 0 && !h.config.AllowTelegramID(updateUserID) {
+		log.Printf("User %d is not allowed to use this bot", updateUserID)
+		h.bot.Send(updateChatID, updateMessageID, "Sorry that I found my OpenAI bill is increasing rapidly, so I decided to temporarily close the public access. If you are interested in using this bot and share the bill, please contact me at @TZJames.")
+		h.bot.SendPhoto(updateChatID, "./resources/bill.jpg")
+		return
+	}
+
+	// only the turns sent to the model create conversations
+	convoID := h.conversationID(update.Message, !update.Message.IsCommand())
+	conversation, ok := h.gpt.Conversations.Get(convoID)
+	if !ok {
+		conversation = h.gpt.NewConversation()
+	}
+
+	if !update.Message.IsCommand() {
+		h.prompt(convoID)
+		if isVoice(update.Message) {
+			transcript, err := h.transcribe(update.Message)
+			if err != nil {
+				log.Printf("Couldn't transcribe voice message: %v", err)
+				h.reply(updateChatID, convoID, updateMessageID, fmt.Sprintf("❌ Couldn't transcribe the message: %v", err))
+				return
+			}
+			h.reply(updateChatID, convoID, updateMessageID, quote(transcript))
+			updateText = transcript
+		}
+		var images []string
+		if len(update.Message.Photo) > 0 {
+			image, err := h.savePhoto(update.Message, convoID)
+			if err != nil {
+				log.Printf("Couldn't save photo: %v", err)
+				h.reply(updateChatID, convoID, updateMessageID, fmt.Sprintf("❌ Couldn't read the photo: %v", err))
+				return
+			}
+			images = append(images, image)
+			updateText = update.Message.Caption
+		}
+		if update.Message.Document != nil {
+			h.bot.SendTyping(updateChatID)
+			doc, err := h.attach(update.Message, convoID)
+			if err != nil {
+				log.Printf("Couldn't attach document: %v", err)
+				h.reply(updateChatID, convoID, updateMessageID, fmt.Sprintf("❌ Couldn't read the document: %v", err))
+				return
+			}
+			h.reply(updateChatID, convoID, updateMessageID, "ℹ️ Attached "+doc.String())
+			if updateText = update.Message.Caption; strings.TrimSpace(updateText) == "" {
+				return // no question about it yet
+			}
+		}
+		log.Println("Received message:\n", updateText)
+
+		turn := h.userTurn(update.Message, updateText)
+		sent := h.answer(updateChatID, convoID, updateMessageID, h.config.IsAdmin(updateUserID),
+			func(ctx context.Context) (chan sse.Chunk, error) {
+				return h.gpt.SendMessage(ctx, turn, convoID, images...)
+			})
+		if !strings.HasPrefix(turn, "!") { // not a plugin query, kept out of the conversation
+			h.finishAnswer(convoID, answer{updateChatID, updateMessageID, sent})
+		}
+		return
+	}
+
+	var text string
+	switch cmd {
+	case "help":
+		text = `/reset: clear the bot's memory of this conversation.
+/stop: stop the answer being written.
+/verbose: switch on the verbose mode of the bot ("/verbose off" to switch off).
+/voice: also send the answers as voice notes ("/voice off" to switch off).
+/ask_friends: allow the bot to ask Bing or Wolfram Alpha before giving an answer.
+/system <message>: send a system prompt to the bot.
+/model <name>: set the model of this chat.
+/temper <value>: set the model temperature (in the range [0.0, 2.0]).
+/py <code>: run Python code in the bot's Python interpreter.
+/image [size=1024x1792] [quality=hd] [n=2] <prompt>: generate images.
+/docs: list the documents attached to this conversation, by sending files.
+/forget <document>: remove a document, given by its name or number.
+/py_reset: restart the Python interpreter of this chat.
+` + openai.SETTINGS_HELP
+	case "start":
+		text = "Send a message to start talking with GPT4. Use /help to find available commands."
+	case "reset":
+		h.gpt.ResetConversation(convoID)
+		h.setLastAnswer(convoID, answer{chatID: updateChatID})
+		text = "ℹ️ Started a new conversation. Enjoy!"
+	case "image":
+		if args == "" {
+			text = "ℹ️ Usage: /image [size=1024x1792] [quality=hd] [n=2] <prompt>"
+			break
+		}
+		h.prompt(convoID)
+		sent := h.answer(updateChatID, convoID, updateMessageID, h.config.IsAdmin(updateUserID),
+			func(ctx context.Context) (chan sse.Chunk, error) {
+				return h.gpt.Imagine(ctx, args, convoID)
+			})
+		h.finishAnswer(convoID, answer{updateChatID, updateMessageID, sent})
+		return
+	case "system":
+		h.prompt(convoID)
+		h.gpt.SendMessage(context.Background(), "/system "+args, convoID)
+		text = "ℹ️ Added system prompt"
+	case "model":
+		settings := conversation.Settings
+		if len(args) == 0 {
+			text = "ℹ️ Current model: " + settings.Model
+		} else if err := settings.Set("model", args); err != nil {
+			text = fmt.Sprintf("❌ %v", err)
+		} else {
+			h.gpt.SetSettings(convoID, settings)
+			text = fmt.Sprintf("ℹ️ Set model to %s", settings.Model)
+		}
+	case "temper":
+		settings := conversation.Settings
+		if err := settings.Set("temperature", args); err != nil {
+			text = "❌ Invalid temperature."
+		} else {
+			h.gpt.SetSettings(convoID, settings)
+			text = fmt.Sprintf("ℹ️ Set temperature to %.2f", settings.Temperature)
+		}
+	case "settings":
+		args := strings.Fields(args)
+		settings := conversation.Settings
+		if len(args) == 0 {
+			text = "ℹ️ Settings:\n\n" + settings.String()
+		} else if args[0] == "reset" {
+			h.gpt.SetSettings(convoID, h.gpt.Defaults)
+			text = "ℹ️ Restored the default settings:\n\n" + h.gpt.Defaults.String()
+		} else if len(args) < 2 {
+			text = "❌ Usage:\n" + openai.SETTINGS_HELP
+		} else if err := settings.Set(args[0], strings.Join(args[1:], " ")); err != nil {
+			text = fmt.Sprintf("❌ %v", err)
+		} else {
+			h.gpt.SetSettings(convoID, settings)
+			text = "ℹ️ Settings:\n\n" + settings.String()
+		}
+	case "verbose":
+		verbose := args != "off"
+		conversation = h.gpt.UpdateConversation(convoID, func(convo *openai.Conversation) {
+			convo.Verbose = verbose
+		})
+		text = fmt.Sprintf("ℹ️ verbose = %s", strconv.FormatBool(conversation.Verbose))
+	case "voice":
+		voice := args != "off"
+		conversation = h.gpt.UpdateConversation(convoID, func(convo *openai.Conversation) {
+			convo.Voice = voice
+		})
+		text = fmt.Sprintf("ℹ️ voice = %s", strconv.FormatBool(conversation.Voice))
+	case "docs":
+		if len(conversation.Documents) == 0 {
+			text = "ℹ️ No documents attached. Send a PDF, Word, text or code file to attach it."
+			break
+		}
+		text = "ℹ️ Documents:\n"
+		for i, doc := range conversation.Documents {
+			text += fmt.Sprintf("\n%d. %s", i+1, doc)
+		}
+	case "forget":
+		if args == "" {
+			text = "ℹ️ Usage: /forget <document name or number>"
+		} else if doc, ok := h.gpt.ForgetDocument(convoID, args); ok {
+			text = "ℹ️ Forgot " + doc.Name
+		} else {
+			text = "❌ Unknown document: " + args
+		}
+	case "py_reset":
+		if h.gpt.Python.Reset(convoID) {
+			text = "ℹ️ Restarted the Python interpreter of this chat."
+		} else {
+			text = "ℹ️ The Python interpreter of this chat is not running."
+		}
+	case "background":
+		text = "ℹ️ Background:\n\n" + h.background
+	case "chats":
+		for _, chatID := range h.gpt.GetChatIDs() {
+			text += fmt.Sprintf("/chat_%d\n", chatID)
+		}
+	case "delete":
+		index, err := strconv.Atoi(args)
+		if err != nil || index < 0 || index >= len(conversation.Messages) {
+			text = "❌ Invalid index."
+		} else {
+			msg := conversation.Messages[index].Content
+			if len(msg) > 20 {
+				msg = msg[:20] + "..."
+			}
+			text = fmt.Sprintf("ℹ️ Deleted message %d: %s", index, msg)
+			h.gpt.DelMessage(convoID, index)
+		}
+	case "save":
+		filename := args
+		if len(filename) == 0 {
+			filename = fmt.Sprintf("chat_%d.json", convoID)
+		}
+		path := filepath.Join("history", filename)
+		err := h.gpt.Save(convoID, path)
+		if err != nil {
+			text = fmt.Sprintf("❌ Failed to save conversation: %v", err)
+		} else {
+			text = fmt.Sprintf("ℹ️ Conversation saved to %s", filename)
+		}
+	case "load":
+		filename := args
+		if len(filename) == 0 {
+			filename = fmt.Sprintf("chat_%d.json", convoID)
+		}
+		path := filepath.Join("history", filename)
+		err := h.gpt.Load(convoID, path)
+		h.setLastAnswer(convoID, answer{chatID: updateChatID})
+		if err != nil {
+			text = fmt.Sprintf("❌ Failed to load conversation: %v", err)
+			break
+		}
+		h.reply(updateChatID, convoID, updateMessageID, fmt.Sprintf("ℹ️ Conversation loaded from %s", filename))
+		// answer the last message of the conversation if it was left unanswered
+		if messages := h.gpt.GetConversation(convoID).Messages; len(messages) > 0 && messages[len(messages)-1].Role == "user" {
+			sent := h.answer(updateChatID, convoID, updateMessageID, h.config.IsAdmin(updateUserID),
+				func(ctx context.Context) (chan sse.Chunk, error) {
+					return h.gpt.Respond(ctx, convoID)
+				})
+			h.finishAnswer(convoID, answer{updateChatID, updateMessageID, sent})
+		}
+		return
+	default:
+		if strings.HasPrefix(cmd, "chat_") {
+			i, err := strconv.Atoi(cmd[5:])
+			if err != nil {
+				text = "Unknown chat ID."
+			} else {
+				convo, _ := h.gpt.Conversations.Get(int64(i))
+				text = convo.GetConversationInfo()
+				for i, msg := range convo.Archive {
+					h.bot.Send(updateChatID, updateMessageID,
+						fmt.Sprintf("(archived %d) %s", i, msg))
+					time.Sleep(300 * time.Millisecond)
+				}
+				if convo.Summary != "" {
+					h.bot.Send(updateChatID, updateMessageID, "ℹ️ Summary:\n\n"+convo.Summary)
+				}
+				for i, msg := range convo.Messages {
+					h.bot.Send(updateChatID, updateMessageID,
+						fmt.Sprintf("(%d) %s", i, msg))
+					time.Sleep(300 * time.Millisecond)
+				}
+			}
+		} else {
+			text = "ℹ️ Unknown command. Send /help to see a list of commands."
+		}
+	}
+
+	if err := h.reply(updateChatID, convoID, updateMessageID, text); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
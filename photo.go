@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/tztsai/openai-telegram/src/imagegen"
+	"github.com/tztsai/openai-telegram/src/openai"
+)
+
+// savePhoto downloads the photo of a message into imagegen.IMAGES_DIR and
+// returns its path. Nothing is downloaded if the model of the conversation
+// can't see images.
+func (h *Handler) savePhoto(m *tgbotapi.Message, convoID int64) (string, error) {
+	if err := openai.CheckVision(h.gpt.GetConversation(convoID).Settings.Model); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(imagegen.IMAGES_DIR, 0755); err != nil {
+		return "", err
+	}
+	photo := m.Photo[len(m.Photo)-1] // the largest size
+	return h.bot.DownloadTo(photo.FileID, imagegen.IMAGES_DIR)
+}
@@ -1,11 +1,14 @@
 package bing
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/tztsai/openai-telegram/src/config"
+	"github.com/tztsai/openai-telegram/src/plugin"
 	"github.com/tztsai/openai-telegram/src/sse"
 )
 
@@ -33,16 +36,20 @@ func (c *API) InitClient() sse.Client {
 	return client
 }
 
-func (c *API) Send(query string) (string, error) {
+func (c *API) Send(ctx context.Context, query string) (string, error) {
 	client := c.InitClient()
 	params := map[string]string{"q": query}
 
-	err := client.Connect("GET", params, nil)
+	err := client.Connect(ctx, "GET", params, nil)
 	if err != nil {
 		return "", err
 	}
 
-	chunk, ok := <-client.EventChannel
+	event, ok := <-client.EventChannel
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	chunk := []byte(event.Data)
 	if len(chunk) == 0 || !ok {
 		return "", fmt.Errorf("no response from Bing")
 	}
@@ -54,6 +61,34 @@ func (c *API) Send(query string) (string, error) {
 	return ExtractResponse(res, 7), nil
 }
 
+func (c *API) Name() string {
+	return "Bing"
+}
+
+func (c *API) Aliases() []string {
+	return []string{"bing"}
+}
+
+func (c *API) Description() string {
+	return "Searches the web with Bing. It can also be used as a world clock and a calculator."
+}
+
+func (c *API) InputSchema() map[string]any {
+	return plugin.StringSchema("The search query.")
+}
+
+func (c *API) Run(ctx context.Context, query string) (plugin.Result, error) {
+	ans, err := c.Send(ctx, strings.Split(query, "\n")[0])
+	if err != nil {
+		return plugin.Result{}, err
+	}
+	if ans == "" {
+		return plugin.Result{}, plugin.ErrNoResult
+	}
+	links := regexp.MustCompile(`\[.*?\]\(.*?\)`).FindAllString(ans, -1)
+	return plugin.Result{Text: ans, Summary: strings.Join(links, "\n")}, nil
+}
+
 func ExtractResponse(resp map[string]any, maxPages int) string {
 	for _, k := range [3]string{"computation", "timeZone", "webPages"} {
 		a, ok := resp[k]
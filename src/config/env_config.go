@@ -3,6 +3,7 @@ package config
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 
@@ -10,15 +11,52 @@ import (
 )
 
 type EnvConfig struct {
-	TelegramID      []int64 `mapstructure:"TELEGRAM_ID"`
-	AllowOthers     bool    `mapstructure:"ALLOW_OTHER_USERS"`
-	TelegramToken   string  `mapstructure:"TELEGRAM_TOKEN"`
-	DefaultModel    string  `mapstructure:"DEFAULT_MODEL"`
-	OpenAIKey       string  `mapstructure:"OPENAI_KEY"`
-	AzureKey        string  `mapstructure:"AZURE_KEY"`
-	WolframAppID    string  `mapstructure:"WOLFRAM_APPID"`
-	PythonPath      string  `mapstructure:"PYTHON_PATH"`
-	EditWaitSeconds int     `mapstructure:"EDIT_WAIT_SECONDS"`
+	TelegramID        []int64  `mapstructure:"TELEGRAM_ID"`
+	AllowOthers       bool     `mapstructure:"ALLOW_OTHER_USERS"`
+	TelegramToken     string   `mapstructure:"TELEGRAM_TOKEN"`
+	DefaultModel      string   `mapstructure:"DEFAULT_MODEL"`
+	OpenAIKey         string   `mapstructure:"OPENAI_KEY"`
+	AzureKey          string   `mapstructure:"AZURE_KEY"`
+	WolframAppID      string   `mapstructure:"WOLFRAM_APPID"`
+	PythonPath        string   `mapstructure:"PYTHON_PATH"`
+	EditWaitSeconds   int      `mapstructure:"EDIT_WAIT_SECONDS"`
+	LegacyPlugins     bool     `mapstructure:"LEGACY_PLUGINS"`
+	DBPath            string   `mapstructure:"DB_PATH"`
+	SummaryThreshold  int      `mapstructure:"SUMMARY_THRESHOLD"`
+	PythonTimeout     int      `mapstructure:"PYTHON_TIMEOUT"`
+	PythonCPUTime     int      `mapstructure:"PYTHON_CPU_TIME"`
+	PythonMemory      int      `mapstructure:"PYTHON_MEMORY"`
+	PythonMaxOutput   int      `mapstructure:"PYTHON_MAX_OUTPUT"`
+	PythonNoNetwork   bool     `mapstructure:"PYTHON_NO_NETWORK"`
+	PythonNoFiles     bool     `mapstructure:"PYTHON_NO_FILES"`
+	PythonSessionTTL  int      `mapstructure:"PYTHON_SESSION_TTL"`
+	PythonMaxSessions int      `mapstructure:"PYTHON_MAX_SESSIONS"`
+	ShellCommands     []string `mapstructure:"SHELL_COMMANDS"`
+	ShellTimeout      int      `mapstructure:"SHELL_TIMEOUT"`
+	ShellMemory       int      `mapstructure:"SHELL_MEMORY"`
+	ShellTool         bool     `mapstructure:"SHELL_TOOL"`
+	WebhookURL        string   `mapstructure:"WEBHOOK_URL"`
+	WebhookListen     string   `mapstructure:"WEBHOOK_LISTEN"`
+	WebhookSecret     string   `mapstructure:"WEBHOOK_SECRET"`
+	WebhookCert       string   `mapstructure:"WEBHOOK_CERT"`
+	WebhookKey        string   `mapstructure:"WEBHOOK_KEY"`
+	GroupThreads      bool     `mapstructure:"GROUP_THREADS"`
+	STTBackend        string   `mapstructure:"STT_BACKEND"`
+	STTModel          string   `mapstructure:"STT_MODEL"`
+	STTLanguage       string   `mapstructure:"STT_LANGUAGE"`
+	WhisperCppPath    string   `mapstructure:"WHISPER_CPP_PATH"`
+	WhisperCppModel   string   `mapstructure:"WHISPER_CPP_MODEL"`
+	FFmpegPath        string   `mapstructure:"FFMPEG_PATH"`
+	TTSBackend        string   `mapstructure:"TTS_BACKEND"`
+	TTSModel          string   `mapstructure:"TTS_MODEL"`
+	TTSVoice          string   `mapstructure:"TTS_VOICE"`
+	TTSPath           string   `mapstructure:"TTS_PATH"`
+	ImageModel        string   `mapstructure:"IMAGE_MODEL"`
+	ImageSize         string   `mapstructure:"IMAGE_SIZE"`
+	ImageQuality      string   `mapstructure:"IMAGE_QUALITY"`
+	PDFToTextPath     string   `mapstructure:"PDFTOTEXT_PATH"`
+	EmbeddingModel    string   `mapstructure:"EMBEDDING_MODEL"`
+	DocInjectTokens   int      `mapstructure:"DOC_INJECT_TOKENS"`
 }
 
 // emptyConfig is used to initialize viper.
@@ -28,7 +66,44 @@ TELEGRAM_TOKEN=
 OPENAI_KEY=
 WOLFRAM_APPID=
 AZURE_KEY=
-EDIT_WAIT_SECONDS=`
+EDIT_WAIT_SECONDS=
+LEGACY_PLUGINS=
+DB_PATH=
+SUMMARY_THRESHOLD=
+PYTHON_TIMEOUT=
+PYTHON_CPU_TIME=
+PYTHON_MEMORY=
+PYTHON_MAX_OUTPUT=
+PYTHON_NO_NETWORK=
+PYTHON_NO_FILES=
+PYTHON_SESSION_TTL=
+PYTHON_MAX_SESSIONS=
+SHELL_COMMANDS=
+SHELL_TIMEOUT=
+SHELL_MEMORY=
+SHELL_TOOL=
+WEBHOOK_URL=
+WEBHOOK_LISTEN=
+WEBHOOK_SECRET=
+WEBHOOK_CERT=
+WEBHOOK_KEY=
+GROUP_THREADS=
+STT_BACKEND=
+STT_MODEL=
+STT_LANGUAGE=
+WHISPER_CPP_PATH=
+WHISPER_CPP_MODEL=
+FFMPEG_PATH=
+TTS_BACKEND=
+TTS_MODEL=
+TTS_VOICE=
+TTS_PATH=
+IMAGE_MODEL=
+IMAGE_SIZE=
+IMAGE_QUALITY=
+PDFTOTEXT_PATH=
+EMBEDDING_MODEL=
+DOC_INJECT_TOKENS=`
 
 func (e *EnvConfig) AllowTelegramID(id int64) bool {
 	if e.AllowOthers {
@@ -42,6 +117,17 @@ func (e *EnvConfig) AllowTelegramID(id int64) bool {
 	return false
 }
 
+// IsAdmin reports whether a user is listed in TELEGRAM_ID, unlike the other
+// users allowed by ALLOW_OTHER_USERS.
+func (e *EnvConfig) IsAdmin(id int64) bool {
+	for _, v := range e.TelegramID {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
 // LoadEnvConfig loads config from .env file, variables from environment take precedence if provided.
 // If no .env file is provided, config is loaded from environment variables.
 func LoadEnvConfig(path string) (*EnvConfig, error) {
@@ -88,5 +174,97 @@ func (e *EnvConfig) ValidateWithDefaults() error {
 		log.Printf("EDIT_WAIT_SECONDS not set, defaulting to 1")
 		e.EditWaitSeconds = 1
 	}
+	if e.DBPath == "" {
+		e.DBPath = "history/chats.db"
+	}
+	// limits of the Python plugin, negative for no limit
+	if e.PythonTimeout == 0 {
+		e.PythonTimeout = 30
+	}
+	if e.PythonCPUTime == 0 {
+		e.PythonCPUTime = 20
+	}
+	if e.PythonMemory == 0 {
+		e.PythonMemory = 1024
+	}
+	if e.PythonMaxOutput == 0 {
+		e.PythonMaxOutput = 16000
+	}
+	if e.PythonSessionTTL == 0 {
+		e.PythonSessionTTL = 30
+	}
+	if e.PythonMaxSessions == 0 {
+		e.PythonMaxSessions = 8
+	}
+	// limits of the shell commands, negative for no limit
+	if e.ShellTimeout == 0 {
+		e.ShellTimeout = 10
+	}
+	if e.ShellMemory == 0 {
+		e.ShellMemory = 512
+	}
+	if e.WebhookURL != "" && e.WebhookListen == "" {
+		e.WebhookListen = ":8443"
+	}
+	if (e.WebhookCert == "") != (e.WebhookKey == "") {
+		return errors.New("WEBHOOK_CERT and WEBHOOK_KEY must be set together")
+	}
+	switch e.STTBackend {
+	case "", "openai":
+		e.STTBackend = "openai"
+	case "whispercpp":
+		if e.WhisperCppModel == "" {
+			return errors.New("WHISPER_CPP_MODEL is not set")
+		}
+	default:
+		return fmt.Errorf("unknown STT_BACKEND: %s", e.STTBackend)
+	}
+	if e.STTModel == "" {
+		e.STTModel = "whisper-1"
+	}
+	if e.WhisperCppPath == "" {
+		e.WhisperCppPath = "whisper-cli"
+	}
+	if e.FFmpegPath == "" {
+		e.FFmpegPath = "ffmpeg"
+	}
+	switch e.TTSBackend {
+	case "", "openai":
+		e.TTSBackend = "openai"
+		if e.TTSModel == "" {
+			e.TTSModel = "tts-1"
+		}
+		if e.TTSVoice == "" {
+			e.TTSVoice = "alloy"
+		}
+	case "piper":
+		if e.TTSModel == "" {
+			return errors.New("TTS_MODEL is not set")
+		}
+		if e.TTSPath == "" {
+			e.TTSPath = "piper"
+		}
+	case "espeak":
+		if e.TTSPath == "" {
+			e.TTSPath = "espeak-ng"
+		}
+	default:
+		return fmt.Errorf("unknown TTS_BACKEND: %s", e.TTSBackend)
+	}
+	if e.ImageModel == "" {
+		e.ImageModel = "dall-e-3"
+	}
+	if e.ImageSize == "" {
+		e.ImageSize = "1024x1024"
+	}
+	if e.PDFToTextPath == "" {
+		e.PDFToTextPath = "pdftotext"
+	}
+	if e.EmbeddingModel == "" {
+		e.EmbeddingModel = "text-embedding-3-small"
+	}
+	if e.DocInjectTokens == 0 {
+		e.DocInjectTokens = 4000
+	}
 	return nil
 }
@@ -0,0 +1,47 @@
+package dispatch
+
+import (
+	"sync"
+)
+
+// Dispatcher runs jobs in one worker goroutine per key, so that jobs of
+// different keys run in parallel while jobs of the same key run in order.
+// A worker exits when its queue is empty.
+type Dispatcher struct {
+	mu     sync.Mutex
+	queues map[int64][]func()
+}
+
+func New() *Dispatcher {
+	return &Dispatcher{
+		queues: make(map[int64][]func()),
+	}
+}
+
+func (d *Dispatcher) Dispatch(key int64, job func()) {
+	d.mu.Lock()
+	queue, running := d.queues[key]
+	d.queues[key] = append(queue, job)
+	d.mu.Unlock()
+
+	if !running {
+		go d.work(key)
+	}
+}
+
+func (d *Dispatcher) work(key int64) {
+	for {
+		d.mu.Lock()
+		queue := d.queues[key]
+		if len(queue) == 0 {
+			delete(d.queues, key)
+			d.mu.Unlock()
+			return
+		}
+		job := queue[0]
+		d.queues[key] = queue[1:]
+		d.mu.Unlock()
+
+		job()
+	}
+}
@@ -0,0 +1,109 @@
+package dispatch
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatchKeepsOrderWithinKey(t *testing.T) {
+	d := New()
+	const keys, jobs = 4, 200
+	var mu sync.Mutex
+	order := make(map[int64][]int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		for key := int64(0); key < keys; key++ {
+			i, key := i, key
+			wg.Add(1)
+			d.Dispatch(key, func() {
+				defer wg.Done()
+				mu.Lock()
+				order[key] = append(order[key], i)
+				mu.Unlock()
+			})
+		}
+	}
+	wg.Wait()
+
+	for key := int64(0); key < keys; key++ {
+		if len(order[key]) != jobs {
+			t.Fatalf("key %d ran %d jobs, want %d", key, len(order[key]), jobs)
+		}
+		for i, job := range order[key] {
+			if job != i {
+				t.Fatalf("key %d ran job %d at position %d", key, job, i)
+			}
+		}
+	}
+}
+
+func TestDispatchDoesNotOverlapWithinKey(t *testing.T) {
+	d := New()
+	var running, overlaps int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		d.Dispatch(1, func() {
+			defer wg.Done()
+			mu.Lock()
+			running++
+			if running > 1 {
+				overlaps++
+			}
+			mu.Unlock()
+			time.Sleep(100 * time.Microsecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	if overlaps > 0 {
+		t.Errorf("%d jobs of the same key overlapped", overlaps)
+	}
+}
+
+func TestDispatchRunsKeysInParallel(t *testing.T) {
+	d := New()
+	blocked := make(chan struct{})
+	done := make(chan struct{})
+	// the job of key 1 waits for the job of key 2, which can't run if the
+	// keys share a worker
+	d.Dispatch(1, func() {
+		<-blocked
+		close(done)
+	})
+	d.Dispatch(2, func() {
+		close(blocked)
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow job blocked the jobs of another key")
+	}
+}
+
+func TestDispatchRestartsWorker(t *testing.T) {
+	d := New()
+	for i := 0; i < 3; i++ {
+		done := make(chan struct{})
+		d.Dispatch(1, func() { close(done) })
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the job of an idle key did not run")
+		}
+		// let the worker exit with an empty queue
+		for j := 0; j < 100; j++ {
+			d.mu.Lock()
+			_, running := d.queues[1]
+			d.mu.Unlock()
+			if !running {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package docs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// CODE_LANGUAGES maps the extensions of source files to the language of
+// their code blocks.
+var CODE_LANGUAGES = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".ts": "typescript",
+	".jsx": "jsx", ".tsx": "tsx", ".java": "java", ".kt": "kotlin",
+	".scala": "scala", ".c": "c", ".h": "c", ".cpp": "cpp", ".cc": "cpp",
+	".hpp": "cpp", ".cs": "csharp", ".rs": "rust", ".rb": "ruby",
+	".php": "php", ".swift": "swift", ".lua": "lua", ".r": "r",
+	".sh": "bash", ".ps1": "powershell", ".sql": "sql", ".html": "html",
+	".css": "css", ".json": "json", ".yaml": "yaml", ".yml": "yaml",
+	".toml": "toml", ".xml": "xml", ".tex": "latex",
+}
+
+// Extract converts a document to text according to the extension of its
+// name: PDF files with pdftotext, DOCX files, and text files such as
+// Markdown, CSV or source code, the latter in a code block.
+func Extract(ctx context.Context, path string, name string, pdftotext string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch ext {
+	case ".pdf":
+		return extractPDF(ctx, path, pdftotext)
+	case ".docx":
+		return extractDOCX(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return "", fmt.Errorf("unsupported file type: %s", name)
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if language, ok := CODE_LANGUAGES[ext]; ok {
+		text = "```" + language + "\n" + strings.TrimRight(text, "\n") + "\n```"
+	}
+	return text, nil
+}
+
+func extractPDF(ctx context.Context, path string, pdftotext string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pdftotext, "-enc", "UTF-8", path, "-")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("pdftotext failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	// pages are separated by form feeds
+	return strings.ReplaceAll(stdout.String(), "\f", "\n\n"), nil
+}
+
+// extractDOCX returns the text of the paragraphs of a Word document.
+func extractDOCX(path string) (string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		return documentText(rc)
+	}
+	return "", errors.New("not a Word document")
+}
+
+func documentText(r io.Reader) (string, error) {
+	var text strings.Builder
+	decoder := xml.NewDecoder(r)
+	inText := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return text.String(), nil
+		} else if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteString("\t")
+			case "br", "cr":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteString("\n\n")
+			case "tc": // table cell
+				text.WriteString("\t")
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(t)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package docs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/tztsai/openai-telegram/src/markdown"
+)
+
+// DOCS_DIR is the directory of the indexes of the documents attached to the
+// conversations.
+const DOCS_DIR = "history/docs"
+
+// CHUNK_LENGTH is the max length of a chunk of a document in UTF-16 code
+// units.
+const CHUNK_LENGTH = 2000
+
+const EMBEDDINGS_URL = "https://api.openai.com/v1/embeddings"
+
+// EMBED_BATCH is the max number of texts embedded in a request.
+const EMBED_BATCH = 100
+
+// Index is the text of a document cut into chunks, with the embedding of
+// each chunk if the document is searched rather than read as a whole.
+type Index struct {
+	Name       string
+	Chunks     []string
+	Embeddings [][]float32 `json:",omitempty"`
+}
+
+// Chunk cuts a text at paragraph boundaries if possible.
+func Chunk(text string) []string {
+	return markdown.Split(text, CHUNK_LENGTH)
+}
+
+// Save writes the index to a new file of a directory and returns its path.
+func (x *Index) Save(dir string) (string, error) {
+	data, err := json.Marshal(x)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(dir, "doc-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func LoadIndex(path string) (*Index, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var x Index
+	if err := json.Unmarshal(data, &x); err != nil {
+		return nil, err
+	}
+	return &x, nil
+}
+
+// Search returns the k chunks most similar to a query embedding, in the
+// order of the document. Without a query, the first k chunks are returned.
+func (x *Index) Search(query []float32, k int) []string {
+	if k > len(x.Chunks) {
+		k = len(x.Chunks)
+	}
+	if query == nil || len(x.Embeddings) != len(x.Chunks) {
+		return x.Chunks[:k]
+	}
+	order := make([]int, len(x.Chunks))
+	scores := make([]float64, len(x.Chunks))
+	for i, e := range x.Embeddings {
+		order[i], scores[i] = i, cosine(query, e)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	best := order[:k]
+	sort.Ints(best)
+	chunks := make([]string, k)
+	for i, j := range best {
+		chunks[i] = x.Chunks[j]
+	}
+	return chunks
+}
+
+func cosine(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := 0; i < len(a) && i < len(b); i++ {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// Embedder computes embeddings with the embeddings API of OpenAI.
+type Embedder struct {
+	URL   string
+	Key   string
+	Model string
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Embed returns the embeddings of texts, in the same order.
+func (e *Embedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += EMBED_BATCH {
+		end := start + EMBED_BATCH
+		if end > len(texts) {
+			end = len(texts)
+		}
+		batch, err := e.embed(ctx, texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, batch...)
+	}
+	return embeddings, nil
+}
+
+func (e *Embedder) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	data, err := json.Marshal(map[string]any{"model": e.Model, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.Key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res embeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("couldn't decode response: %s", resp.Status)
+	}
+	if res.Error != nil {
+		return nil, errors.New(res.Error.Message)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embedding failed with status %s", resp.Status)
+	} else if len(res.Data) != len(texts) {
+		return nil, fmt.Errorf("got %d embeddings for %d texts", len(res.Data), len(texts))
+	}
+	embeddings := make([][]float32, len(texts))
+	for _, d := range res.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, fmt.Errorf("invalid embedding index %d", d.Index)
+		}
+		embeddings[d.Index] = d.Embedding
+	}
+	return embeddings, nil
+}
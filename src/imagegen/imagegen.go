@@ -0,0 +1,277 @@
+package imagegen
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tztsai/openai-telegram/src/config"
+	"github.com/tztsai/openai-telegram/src/plugin"
+)
+
+const API_URL = "https://api.openai.com/v1/images/generations"
+
+// IMAGES_DIR is the directory of the images sent to the bot or generated by
+// it, to which the conversations refer.
+const IMAGES_DIR = "history/images"
+
+// MAX_IMAGES is the max number of images generated at once.
+const MAX_IMAGES = 4
+
+type API struct {
+	URL     string
+	Key     string
+	Model   string
+	Size    string // default size
+	Quality string // default quality, the one of the model if empty
+	Dir     string // directory of the images returned as base64 data
+}
+
+func Init(config *config.EnvConfig) *API {
+	return &API{
+		URL:     API_URL,
+		Key:     config.OpenAIKey,
+		Model:   config.ImageModel,
+		Size:    config.ImageSize,
+		Quality: config.ImageQuality,
+		Dir:     IMAGES_DIR,
+	}
+}
+
+// Options are the options of a generation, given by the model as the
+// arguments of the tool.
+type Options struct {
+	Prompt  string `json:"prompt"`
+	Size    string `json:"size,omitempty"`
+	Quality string `json:"quality,omitempty"`
+	N       int    `json:"n,omitempty"`
+}
+
+// ParseQuery parses the options of a generation from a JSON object, or from
+// a prompt preceded by "size=", "quality=" and "n=" options.
+func ParseQuery(query string) (Options, error) {
+	var opts Options
+	query = strings.TrimSpace(query)
+	if strings.HasPrefix(query, "{") {
+		err := json.Unmarshal([]byte(query), &opts)
+		return opts, err
+	}
+	for {
+		key, value, ok := strings.Cut(strings.SplitN(query, " ", 2)[0], "=")
+		if !ok {
+			break
+		}
+		switch key {
+		case "size":
+			opts.Size = value
+		case "quality":
+			opts.Quality = value
+		case "n":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid number of images: %s", value)
+			}
+			opts.N = n
+		default: // part of the prompt
+			opts.Prompt = query
+			return opts, nil
+		}
+		_, query, _ = strings.Cut(query, " ")
+		query = strings.TrimSpace(query)
+	}
+	opts.Prompt = query
+	return opts, nil
+}
+
+type image struct {
+	URL           string `json:"url"`
+	B64JSON       string `json:"b64_json"`
+	RevisedPrompt string `json:"revised_prompt"`
+}
+
+type response struct {
+	Data  []image `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Generate generates images and returns their URLs, or the paths of the
+// files they are saved to if returned as data, with the prompt revised by
+// the model if any.
+func (c *API) Generate(ctx context.Context, opts Options) ([]string, string, error) {
+	if strings.TrimSpace(opts.Prompt) == "" {
+		return nil, "", errors.New("no prompt given")
+	}
+	if opts.Size == "" {
+		opts.Size = c.Size
+	}
+	if opts.Quality == "" {
+		opts.Quality = c.Quality
+	}
+	if opts.N <= 0 {
+		opts.N = 1
+	} else if opts.N > MAX_IMAGES {
+		return nil, "", fmt.Errorf("at most %d images can be generated at once", MAX_IMAGES)
+	}
+
+	// DALL·E 3 generates a single image per request
+	perRequest := opts.N
+	if c.Model == "dall-e-3" {
+		perRequest = 1
+	}
+	var images []image
+	for len(images) < opts.N {
+		n := opts.N - len(images)
+		if n > perRequest {
+			n = perRequest
+		}
+		batch, err := c.request(ctx, opts, n)
+		if err != nil {
+			return nil, "", err
+		}
+		images = append(images, batch...)
+	}
+
+	var refs []string
+	revised := ""
+	for _, img := range images {
+		if img.RevisedPrompt != "" && revised == "" {
+			revised = img.RevisedPrompt
+		}
+		if img.URL != "" {
+			refs = append(refs, img.URL)
+			continue
+		}
+		path, err := c.save(img.B64JSON)
+		if err != nil {
+			return nil, "", err
+		}
+		refs = append(refs, path)
+	}
+	return refs, revised, nil
+}
+
+func (c *API) request(ctx context.Context, opts Options, n int) ([]image, error) {
+	body := map[string]any{
+		"model":  c.Model,
+		"prompt": opts.Prompt,
+		"n":      n,
+	}
+	if opts.Size != "" {
+		body["size"] = opts.Size
+	}
+	if opts.Quality != "" {
+		body["quality"] = opts.Quality
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res response
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("couldn't decode response: %s", resp.Status)
+	}
+	if res.Error != nil {
+		return nil, errors.New(res.Error.Message)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image generation failed with status %s", resp.Status)
+	} else if len(res.Data) == 0 {
+		return nil, plugin.ErrNoResult
+	}
+	return res.Data, nil
+}
+
+// save writes an image returned as base64 data to a new file of Dir.
+func (c *API) save(b64 string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(c.Dir, "generated-*.png")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, bytes.NewReader(data)); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func (c *API) Name() string {
+	return "Image"
+}
+
+func (c *API) Aliases() []string {
+	return []string{"image", "img", "dalle"}
+}
+
+func (c *API) Description() string {
+	return "Generates images from a description and shows them to the user. To change an image generated before, describe the whole image again with the changes."
+}
+
+func (c *API) InputSchema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"prompt": plugin.StringSchema("A detailed description of the image."),
+			"size": plugin.StringSchema(
+				"The size of the image, e.g. 1024x1024, 1792x1024 (landscape) or 1024x1792 (portrait)."),
+			"quality": plugin.StringSchema(
+				"The quality of the image, e.g. standard or hd for DALL·E 3, low, medium or high for GPT Image."),
+			"n": map[string]any{
+				"type":        "integer",
+				"description": "The number of images.",
+				"minimum":     1,
+				"maximum":     MAX_IMAGES,
+			},
+		},
+		"required": []string{"prompt"},
+	}
+}
+
+func (c *API) Run(ctx context.Context, query string) (plugin.Result, error) {
+	opts, err := ParseQuery(query)
+	if err != nil {
+		return plugin.Result{}, err
+	}
+	images, revised, err := c.Generate(ctx, opts)
+	if err != nil {
+		return plugin.Result{}, err
+	}
+
+	prompt := opts.Prompt
+	if revised != "" {
+		prompt = revised
+	}
+	text := fmt.Sprintf("Generated %d image(s) for the prompt: %s", len(images), prompt)
+	for i, img := range images {
+		text += fmt.Sprintf("\n%d. %s", i+1, img)
+	}
+	return plugin.Result{Text: text, Summary: "🎨 " + prompt, Images: images}, nil
+}
@@ -0,0 +1,406 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	FENCE_PAT      = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`\\s]*)[^`]*$")
+	HEADING_PAT    = regexp.MustCompile(`^ {0,3}#{1,6}(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	RULE_PAT       = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	QUOTE_PAT      = regexp.MustCompile(`^ {0,3}>[ \t]?`)
+	BULLET_PAT     = regexp.MustCompile(`^([ \t]*)[-*+][ \t]+(?:\[([ xX])\][ \t]+)?(.*)$`)
+	ORDERED_PAT    = regexp.MustCompile(`^([ \t]*)(\d{1,9}[.)])[ \t]+(.*)$`)
+	TABLE_SEP_PAT  = regexp.MustCompile(`^[ \t]*\|?[ \t]*:?-+:?[ \t]*(\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	AUTOLINK_PAT   = regexp.MustCompile(`^<((?:https?|tg|mailto):[^\s<>]+)>`)
+	URL_PAT        = regexp.MustCompile(`(?i)^(?:https?://|tg://|mailto:)`)
+	LINK_TARGET    = regexp.MustCompile(`^\(\s*<?([^\s()<>]*(?:\([^\s()<>]*\)[^\s()<>]*)*)>?(?:\s+(?:"[^"]*"|'[^']*'))?\s*\)`)
+	htmlEscaper    = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	htmlAttrEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+// ToHTML converts GitHub-flavored Markdown to the subset of HTML supported
+// by Telegram, escaping the rest of the text. Headings become bold, tables
+// become preformatted text, and fenced code blocks keep their language. An
+// unclosed code block extends to the end of the text.
+func ToHTML(text string) string {
+	lines := strings.Split(text, "\n")
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if m := FENCE_PAT.FindStringSubmatch(line); m != nil {
+			var code []string
+			for i++; i < len(lines) && !closesFence(lines[i], m[2]); i++ {
+				code = append(code, trimIndent(lines[i], len(m[1])))
+			}
+			out = append(out, codeBlock(strings.Join(code, "\n"), m[3]))
+		} else if i+1 < len(lines) && strings.Contains(line, "|") && strings.Contains(lines[i+1], "|") &&
+			TABLE_SEP_PAT.MatchString(lines[i+1]) {
+			rows := [][]string{splitRow(line)}
+			for i += 2; i < len(lines) && strings.Contains(lines[i], "|"); i++ {
+				rows = append(rows, splitRow(lines[i]))
+			}
+			i--
+			out = append(out, "<pre>"+htmlEscaper.Replace(formatTable(rows))+"</pre>")
+		} else if RULE_PAT.MatchString(line) {
+			out = append(out, "——————")
+		} else if m := HEADING_PAT.FindStringSubmatch(line); m != nil {
+			out = append(out, "<b>"+inlineHTML(m[1], NESTED)+"</b>")
+		} else if QUOTE_PAT.MatchString(line) {
+			var quote []string
+			for ; i < len(lines) && QUOTE_PAT.MatchString(lines[i]); i++ {
+				// nested quotes are flattened, Telegram doesn't support them
+				inner := lines[i]
+				for QUOTE_PAT.MatchString(inner) {
+					inner = QUOTE_PAT.ReplaceAllString(inner, "")
+				}
+				quote = append(quote, inlineHTML(inner, TOP))
+			}
+			i--
+			out = append(out, "<blockquote>"+strings.Join(quote, "\n")+"</blockquote>")
+		} else if m := BULLET_PAT.FindStringSubmatch(line); m != nil {
+			bullet := "•"
+			if m[2] == " " {
+				bullet = "☐"
+			} else if m[2] != "" {
+				bullet = "☑"
+			}
+			out = append(out, m[1]+bullet+" "+inlineHTML(m[3], TOP))
+		} else if m := ORDERED_PAT.FindStringSubmatch(line); m != nil {
+			out = append(out, m[1]+m[2]+" "+inlineHTML(m[3], TOP))
+		} else {
+			out = append(out, inlineHTML(line, TOP))
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// RenderedLen returns the length in UTF-16 code units of the text displayed
+// by Telegram for a Markdown text converted by ToHTML, which is the length
+// limited for messages.
+func RenderedLen(text string) int {
+	return UTF16Len(html.UnescapeString(TAG_PAT.ReplaceAllString(ToHTML(text), "")))
+}
+
+// closesFence reports whether a line closes a code block opened by fence.
+func closesFence(line, fence string) bool {
+	line = strings.TrimRight(line, " \t")
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 || len(trimmed) < len(fence) {
+		return false
+	}
+	return strings.Trim(trimmed, fence[:1]) == ""
+}
+
+// trimIndent removes up to n spaces at the start of a line.
+func trimIndent(line string, n int) string {
+	for i := 0; i < n && strings.HasPrefix(line, " "); i++ {
+		line = line[1:]
+	}
+	return line
+}
+
+func codeBlock(code, language string) string {
+	code = htmlEscaper.Replace(code)
+	if language == "" {
+		return "<pre>" + code + "</pre>"
+	}
+	return `<pre><code class="language-` + htmlAttrEscape.Replace(language) + `">` + code + "</code></pre>"
+}
+
+// splitRow returns the cells of a row of a table.
+func splitRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' && i+1 < len(line) && line[i+1] == '|' {
+			cell.WriteByte('|')
+			i++
+		} else if line[i] == '|' {
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		} else {
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// formatTable aligns the columns of a table, with a rule under its header.
+func formatTable(rows [][]string) string {
+	var widths []int
+	for _, row := range rows {
+		for j, cell := range row {
+			if j == len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(cell); n > widths[j] {
+				widths[j] = n
+			}
+		}
+	}
+	var lines []string
+	for i, row := range rows {
+		var cells []string
+		for j, width := range widths {
+			cell := ""
+			if j < len(row) {
+				cell = row[j]
+			}
+			cells = append(cells, cell+strings.Repeat(" ", width-utf8.RuneCountInString(cell)))
+		}
+		lines = append(lines, strings.TrimRight(strings.Join(cells, " | "), " "))
+		if i == 0 {
+			var rule []string
+			for _, width := range widths {
+				rule = append(rule, strings.Repeat("-", width))
+			}
+			lines = append(lines, strings.Join(rule, "-+-"))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Nesting is the kind of entity containing an inline text.
+type nesting int
+
+const (
+	TOP     nesting = iota // not in an entity
+	NESTED                 // in a heading or an emphasis
+	IN_LINK                // in the label of a link
+)
+
+// inlineHTML converts the inline elements of Markdown: code spans, emphasis,
+// strikethrough and links. Telegram doesn't allow code inside other
+// entities, nor links inside links, so they are left as plain text if
+// nested.
+func inlineHTML(s string, nested nesting) string {
+	var out strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && isPunct(s[i+1]):
+			out.WriteString(htmlEscaper.Replace(s[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '`':
+			n := runLength(s, i)
+			if end := findCodeEnd(s, i+n, n); end >= 0 {
+				code := s[i+n : end]
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+					code = code[1 : len(code)-1]
+				}
+				if nested != TOP {
+					out.WriteString(htmlEscaper.Replace(code))
+				} else {
+					out.WriteString("<code>" + htmlEscaper.Replace(code) + "</code>")
+				}
+				i = end + n
+			} else {
+				out.WriteString(s[i : i+n])
+				i += n
+			}
+			continue
+		case c == '<':
+			if m := AUTOLINK_PAT.FindStringSubmatch(s[i:]); m != nil {
+				if nested == IN_LINK {
+					out.WriteString(htmlEscaper.Replace(m[1]))
+				} else {
+					out.WriteString(link(m[1], htmlEscaper.Replace(m[1])))
+				}
+				i += len(m[0])
+				continue
+			}
+		case c == '[' || c == '!' && i+1 < len(s) && s[i+1] == '[':
+			start := i
+			if c == '!' {
+				start++
+			}
+			if end := findBracket(s, start); end >= 0 {
+				if m := LINK_TARGET.FindStringSubmatch(s[end+1:]); m != nil && m[1] != "" {
+					label := s[start+1 : end]
+					if label == "" {
+						label = m[1]
+					}
+					if nested == IN_LINK {
+						out.WriteString(inlineHTML(label, IN_LINK))
+					} else {
+						out.WriteString(link(m[1], inlineHTML(label, IN_LINK)))
+					}
+					i = end + 1 + len(m[0])
+					continue
+				}
+			}
+		case c == '*' || c == '_' || c == '~':
+			if html, end, ok := emphasis(s, i, nested); ok {
+				out.WriteString(html)
+				i = end
+				continue
+			}
+			n := runLength(s, i)
+			out.WriteString(s[i : i+n])
+			i += n
+			continue
+		}
+		out.WriteString(htmlEscaper.Replace(s[i : i+1]))
+		i++
+	}
+	return out.String()
+}
+
+// link returns a link to url, or the label followed by url if it is not
+// absolute, since Telegram rejects such links.
+func link(url, label string) string {
+	if !URL_PAT.MatchString(url) {
+		return label + " (" + htmlEscaper.Replace(url) + ")"
+	}
+	return `<a href="` + htmlAttrEscape.Replace(url) + `">` + label + "</a>"
+}
+
+// emphasis converts the emphasis or strikethrough opened by the delimiter
+// run at i, returning the HTML and the end of its closing run.
+func emphasis(s string, i int, nested nesting) (string, int, bool) {
+	c := s[i]
+	n := runLength(s, i)
+	if n > 3 || c == '~' && n != 2 || !canOpen(s, i, n) {
+		return "", 0, false
+	}
+	for j := i + n; j < len(s); {
+		switch {
+		case s[j] == '\\':
+			j += 2
+			continue
+		case s[j] == '`':
+			m := runLength(s, j)
+			if end := findCodeEnd(s, j+m, m); end >= 0 {
+				j = end + m
+			} else {
+				j += m
+			}
+			continue
+		case s[j] == c:
+			m := runLength(s, j)
+			if m == n && canClose(s, j, m) {
+				if nested == TOP {
+					nested = NESTED
+				}
+				inner := inlineHTML(s[i+n:j], nested)
+				var open, close string
+				switch {
+				case c == '~':
+					open, close = "<s>", "</s>"
+				case n == 1:
+					open, close = "<i>", "</i>"
+				case n == 2:
+					open, close = "<b>", "</b>"
+				default:
+					open, close = "<b><i>", "</i></b>"
+				}
+				return open + inner + close, j + m, true
+			}
+			j += m
+			continue
+		}
+		j++
+	}
+	return "", 0, false
+}
+
+// canOpen reports whether the delimiter run of length n at i can open an
+// emphasis: it must be followed by a non-space, and for underscores, not be
+// inside a word.
+func canOpen(s string, i, n int) bool {
+	next, _ := utf8.DecodeRuneInString(s[i+n:])
+	if i+n >= len(s) || unicode.IsSpace(next) {
+		return false
+	}
+	if s[i] == '_' && i > 0 {
+		prev, _ := utf8.DecodeLastRuneInString(s[:i])
+		return !isWordRune(prev)
+	}
+	return true
+}
+
+// canClose reports whether the delimiter run of length n at j can close an
+// emphasis.
+func canClose(s string, j, n int) bool {
+	prev, _ := utf8.DecodeLastRuneInString(s[:j])
+	if unicode.IsSpace(prev) {
+		return false
+	}
+	if s[j] == '_' && j+n < len(s) {
+		next, _ := utf8.DecodeRuneInString(s[j+n:])
+		return !isWordRune(next)
+	}
+	return true
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isPunct(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || strings.IndexByte("$+<=>^`|~", c) >= 0
+}
+
+// runLength returns the number of repetitions of the byte at i.
+func runLength(s string, i int) int {
+	n := 1
+	for i+n < len(s) && s[i+n] == s[i] {
+		n++
+	}
+	return n
+}
+
+// findCodeEnd returns the start of the run of n backticks closing a code
+// span starting at i, or -1.
+func findCodeEnd(s string, i, n int) int {
+	for i < len(s) {
+		j := strings.IndexByte(s[i:], '`')
+		if j < 0 {
+			return -1
+		}
+		i += j
+		m := runLength(s, i)
+		if m == n {
+			return i
+		}
+		i += m
+	}
+	return -1
+}
+
+// findBracket returns the index of the bracket closing the one at i, or -1.
+func findBracket(s string, i int) int {
+	depth := 0
+	for j := i; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '`':
+			n := runLength(s, j)
+			if end := findCodeEnd(s, j+n, n); end >= 0 {
+				j = end + n - 1
+			} else {
+				j += n - 1
+			}
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,52 @@
+package markdown
+
+import "testing"
+
+func TestToHTML(t *testing.T) {
+	tests := []struct {
+		name, markdown, html string
+	}{
+		{"escaping", "a < b && c > d", "a &lt; b &amp;&amp; c &gt; d"},
+		{"escaped tags in entities", "`x < 1` and **<b>**", "<code>x &lt; 1</code> and <b>&lt;b&gt;</b>"},
+		{"backslash escapes", `\*not italic\* 1 \< 2`, "*not italic* 1 &lt; 2"},
+		{"fenced code", "```go\nif a < b {\n}\n```", `<pre><code class="language-go">if a &lt; b {` + "\n}</code></pre>"},
+		{"tilde fence", "~~~python\nx\n~~~", `<pre><code class="language-python">x</code></pre>`},
+		{"fence without language", "```\nplain\n```", "<pre>plain</pre>"},
+		{"unclosed fence", "```sh\necho 1", `<pre><code class="language-sh">echo 1</code></pre>`},
+		{"link", "[x](http://a?b=1&c=\"2\")", `<a href="http://a?b=1&amp;c=&quot;2&quot;">x</a>`},
+		{"relative link", "[rel](docs/x.md)", "rel (docs/x.md)"},
+		{"nested link", "[a [b](http://u)](http://v)", `<a href="http://v">a b</a>`},
+		{"autolink in link", "[see <https://u.v>](http://v)", `<a href="http://v">see https://u.v</a>`},
+		{"link in bold", "**bold [link](https://x.y)**", `<b>bold <a href="https://x.y">link</a></b>`},
+		{"code in link", "[`code`](https://x.y)", `<a href="https://x.y">code</a>`},
+		{"heading", "# Title *it*", "<b>Title <i>it</i></b>"},
+		{"emphasis", "*i* **b** ***bi*** ~~s~~", "<i>i</i> <b>b</b> <b><i>bi</i></b> <s>s</s>"},
+		{"underscores in words", "snake_case_word and _it_", "snake_case_word and <i>it</i>"},
+		{"quote", "> quote\n> > nested", "<blockquote>quote\nnested</blockquote>"},
+		{"lists", "- [x] done\n- [ ] todo\n* item\n1. one", "☑ done\n☐ todo\n• item\n1. one"},
+		{"table", "| a | b |\n|---|---|\n| 1 | 22 |", "<pre>a | b\n--+---\n1 | 22</pre>"},
+		{"rule", "---", "——————"},
+	}
+	for _, tt := range tests {
+		if html := ToHTML(tt.markdown); html != tt.html {
+			t.Errorf("%s: ToHTML(%q) = %q, want %q", tt.name, tt.markdown, html, tt.html)
+		}
+	}
+}
+
+func TestRenderedLen(t *testing.T) {
+	tests := []struct {
+		markdown string
+		length   int
+	}{
+		{"**bold** & `code`", len("bold & code")},
+		{"[label](https://example.com)", len("label")},
+		{"😀 <tag>", 2 + len(" <tag>")},
+		{"| a | b |\n|---|---|\n| 1 | 22 |", len("a | b\n--+---\n1 | 22")},
+	}
+	for _, tt := range tests {
+		if n := RenderedLen(tt.markdown); n != tt.length {
+			t.Errorf("RenderedLen(%q) = %d, want %d", tt.markdown, n, tt.length)
+		}
+	}
+}
@@ -2,38 +2,271 @@ package markdown
 
 import (
 	"strings"
+	"unicode/utf8"
 )
 
-func EnsureFormatting(text string, block_closed bool) (string, bool) {
-	segs := strings.Split(text, "```")
+// FENCE_RESERVE is the length kept free at the end of a part to close the
+// code block cut by Cut.
+const FENCE_RESERVE = 8
 
-	if !block_closed { // prepend "```" because the previous code block was not closed
-		segs = append([]string{""}, segs...)
-		block_closed = true
+// Boundaries at which a text can be cut, from the most to the least
+// preferred.
+const (
+	PARAGRAPH = iota
+	LINE
+	SENTENCE
+	CODE_LINE // a line inside a code block, which is closed and reopened
+	WORD
+	NUM_BOUNDARIES
+)
+
+// boundary is a position at which a text can be cut: the head ends at end
+// and the tail starts at next.
+type boundary struct {
+	end, next int
+	fence     string // fence of the code block open at the boundary, if any
+	language  string
+}
+
+// UTF16Len returns the length of a text in UTF-16 code units, in which
+// Telegram measures the length of messages.
+func UTF16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
 	}
+	return n
+}
 
-	if (len(segs) % 2) == 0 { // append "```" because the current code block is not closed
-		segs = append(segs, "")
-		block_closed = false
+// utf16Prefix returns the length in bytes of the longest prefix of s fitting
+// in max UTF-16 code units, without cutting a rune.
+func utf16Prefix(s string, max int) int {
+	n := 0
+	for i, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+		if n > max {
+			return i
+		}
 	}
+	return len(s)
+}
+
+// Split splits a text into parts of at most max UTF-16 code units with Cut.
+func Split(text string, max int) []string {
+	return split(text, max, Cut)
+}
+
+// SplitRendered splits a text into parts of at most max UTF-16 code units
+// once rendered by ToHTML, with CutRendered.
+func SplitRendered(text string, max int) []string {
+	return split(text, max, CutRendered)
+}
+
+func split(text string, max int, cut func(string, int) (string, string)) []string {
+	var parts []string
+	for {
+		head, tail := cut(text, max)
+		parts = append(parts, head)
+		if tail == "" {
+			return parts
+		}
+		text = tail
+	}
+}
+
+// Cut returns a head of a text of at most max UTF-16 code units, and the
+// rest of the text. The text is cut at a paragraph, line, sentence or word
+// boundary, outside code blocks and inline formatting if possible, and
+// never inside a rune. A code block cut in two is closed at the end of the
+// head and reopened with its language at the start of the tail.
+func Cut(text string, max int) (string, string) {
+	if UTF16Len(text) <= max {
+		return text, ""
+	}
+	limit := utf16Prefix(text, max-FENCE_RESERVE)
+	if limit == 0 { // make progress anyway
+		_, limit = utf8.DecodeRuneInString(text)
+	}
+
+	var best [NUM_BOUNDARIES]*boundary
+	hard := boundary{end: limit, next: limit} // cut at the limit
+	var fence, language string                // of the open code block
+	for pos := 0; pos < limit; {
+		lineEnd := len(text)
+		if i := strings.IndexByte(text[pos:], '\n'); i >= 0 {
+			lineEnd = pos + i
+		}
+		line := text[pos:lineEnd]
 
-	// pat := regexp.MustCompile(`([*_])`)
+		opening := false
+		if fence == "" {
+			if m := FENCE_PAT.FindStringSubmatch(line); m != nil {
+				fence, language, opening = m[2], m[3], true
+			}
+		} else if closesFence(line, fence) {
+			fence, language = "", ""
+		}
+		if lineEnd >= limit {
+			hard.fence, hard.language = fence, language
+		}
 
-	// for i, seg := range segs {
-	// 	if (i % 2) == 0 { // not in code block
-	// 		ss := strings.Split(seg, "`") // WARN: does not handle escaped backticks
-	// 		if (len(ss) % 2) == 1 {       // backticks balanced
-	// 			for j, s := range ss {
-	// 				if (j % 2) == 0 { // not in inline code
-	// 					// replace * with \* and _ with \_
-	// 					ss[j] = pat.ReplaceAllString(s, `\$1`)
-	// 				}
-	// 			}
-	// 		}
-	// 		segs[i] = strings.Join(ss, "`")
-	// 	}
-	// }
+		if fence == "" || opening {
+			// inside the line, at the last sentence or word boundary
+			for i := pos; i < lineEnd && i < limit; {
+				r, size := utf8.DecodeRuneInString(text[i:])
+				i += size
+				if r == ' ' && i <= limit && balanced(text[pos:i-1]) {
+					b := &boundary{end: i - 1, next: i}
+					prev, _ := utf8.DecodeLastRuneInString(text[pos : i-1])
+					if strings.ContainsRune(".!?:;", prev) {
+						best[SENTENCE] = b
+					} else {
+						best[WORD] = b
+					}
+				} else if strings.ContainsRune("。！？", r) && i <= limit {
+					best[SENTENCE] = &boundary{end: i, next: i}
+				}
+			}
+		}
+
+		if lineEnd >= limit || lineEnd == len(text) {
+			break
+		}
+		nextLine := text[lineEnd+1:]
+		if i := strings.IndexByte(nextLine, '\n'); i >= 0 {
+			nextLine = nextLine[:i]
+		}
+		b := &boundary{end: lineEnd, next: lineEnd + 1, fence: fence, language: language}
+		switch {
+		case fence == "":
+			if strings.TrimSpace(nextLine) == "" || FENCE_PAT.MatchString(nextLine) {
+				best[PARAGRAPH] = b
+			} else {
+				best[LINE] = b
+			}
+		case !opening && !closesFence(nextLine, fence):
+			best[CODE_LINE] = b
+		}
+		hard.fence, hard.language = fence, language // if the next line is at the limit
+		pos = lineEnd + 1
+	}
+
+	// the most preferred boundary in the second half, or the last one
+	cut := &hard
+	for _, b := range best {
+		if b != nil && b.end >= limit/2 {
+			cut = b
+			break
+		}
+	}
+	if cut == &hard {
+		for _, b := range best {
+			if b != nil && b.end > 0 && (cut == &hard || b.end > cut.end) {
+				cut = b
+			}
+		}
+	}
+
+	if cut == &hard {
+		// not inside a run of formatting markers
+		end := cut.end
+		for end > 0 && strings.IndexByte("*~`", text[end-1]) >= 0 {
+			end--
+		}
+		if end > 0 {
+			cut.end, cut.next = end, end
+		}
+	}
+
+	inLine := cut.end < len(text) && text[cut.end] != '\n'
+	head, tail := text[:cut.end], text[cut.next:]
+	if cut.fence != "" {
+		head = strings.TrimRight(head, "\n") + "\n" + cut.fence
+		line, rest, _ := strings.Cut(tail, "\n")
+		if closesFence(line, cut.fence) { // the block ends at the cut
+			tail = strings.TrimLeft(rest, "\n")
+		} else {
+			tail = cut.fence + cut.language + "\n" + tail
+		}
+	} else {
+		head = strings.TrimRight(head, " \t\n")
+		tail = strings.TrimLeft(tail, "\n")
+		// a span of inline formatting cut in two is closed at the end of the
+		// head and reopened at the start of the tail
+		line := head[strings.LastIndexByte(head, '\n')+1:]
+		if open := openMarkers(line); inLine && len(open) > 0 {
+			for i := len(open) - 1; i >= 0; i-- {
+				head += open[i]
+			}
+			tail = strings.Join(open, "") + strings.TrimLeft(tail, " \t")
+		}
+	}
+	return head, tail
+}
+
+// openMarkers returns the markers of the code spans, bold and strikethrough
+// left open at the end of a line, in the order they were opened.
+func openMarkers(line string) []string {
+	var open []string
+	for i := 0; i < len(line); {
+		var marker string
+		switch {
+		case line[i] == '\\':
+			i += 2
+			continue
+		case line[i] == '`':
+			marker = "`"
+		case strings.HasPrefix(line[i:], "**"):
+			marker = "**"
+		case strings.HasPrefix(line[i:], "~~"):
+			marker = "~~"
+		default:
+			i++
+			continue
+		}
+		i += len(marker)
+		n := len(open)
+		if n > 0 && open[n-1] == marker {
+			open = open[:n-1]
+		} else if n == 0 || open[n-1] != "`" { // no formatting in code
+			open = append(open, marker)
+		}
+	}
+	return open
+}
+
+// CutRendered is Cut for a text sent with ToHTML: the head is at most max
+// UTF-16 code units both as Markdown, to be sent as plain text if its HTML
+// is rejected, and as the text rendered by Telegram, which is longer than
+// the Markdown for padded tables.
+func CutRendered(text string, max int) (string, string) {
+	limit := max
+	for {
+		head, tail := Cut(text, limit)
+		n := RenderedLen(head)
+		if n <= max || limit <= FENCE_RESERVE+1 {
+			return head, tail
+		}
+		if shorter := limit * max / n; shorter < limit {
+			limit = shorter
+		} else {
+			limit--
+		}
+	}
+}
 
-	text = strings.Join(segs, "```")
-	return text, block_closed
+// balanced reports whether the links of a line are closed, so that it can be
+// cut there. The code spans and formatting cut are closed and reopened by
+// Cut.
+func balanced(line string) bool {
+	return strings.Count(line, "[") == strings.Count(line, "]") &&
+		strings.Count(line, "(") == strings.Count(line, ")")
 }
@@ -0,0 +1,144 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestUTF16Len(t *testing.T) {
+	tests := []struct {
+		text   string
+		length int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"é東京", 3},
+		{"😀", 2},
+		{"a😀b👍🏽", 8}, // the skin tone is another code point
+	}
+	for _, tt := range tests {
+		if n := UTF16Len(tt.text); n != tt.length {
+			t.Errorf("UTF16Len(%q) = %d, want %d", tt.text, n, tt.length)
+		}
+	}
+}
+
+// entitiesClosed reports whether every entity of an HTML text is closed.
+func entitiesClosed(html string) bool {
+	for _, tag := range []string{"b", "i", "s", "a", "code", "pre", "blockquote"} {
+		opened := strings.Count(html, "<"+tag+">") + strings.Count(html, "<"+tag+" ")
+		if opened != strings.Count(html, "</"+tag+">") {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCut(t *testing.T) {
+	words := strings.Repeat("word ", 30)
+	tests := []struct {
+		name string
+		text string
+		max  int
+		head string // expected head, if not empty
+		tail string // expected start of the tail, if not empty
+	}{
+		{"short text", "hello world", 20, "hello world", ""},
+		{"paragraph", "first paragraph.\n\nsecond one which is longer", 30, "first paragraph.", "second"},
+		{"sentence", "One sentence here. Another sentence follows it", 35, "One sentence here.", "Another"},
+		{"emoji", strings.Repeat("😀", 40), 21, strings.Repeat("😀", 6), "😀"},
+		{"emoji after ascii", "a" + strings.Repeat("😀", 40), 22, "a" + strings.Repeat("😀", 6), "😀"},
+		{"code block", "```go\n" + strings.Repeat("x := 1\n", 20) + "```", 60,
+			"```go\n" + strings.Repeat("x := 1\n", 6) + "```", "```go\nx := 1\n"},
+		{"closing fence at the limit", "```python\nprint('hello, world')\n```\n\nA paragraph with words", 40,
+			"```python\nprint('hello, world')\n```", "A paragraph"},
+		{"bold span", "**" + words + "end**", 60, "**" + strings.TrimSpace(words[:50]) + "**", "**word"},
+		{"code span", "`" + words + "end`", 60, "`" + strings.TrimSpace(words[:50]) + "`", "`word"},
+		{"link", "see " + strings.Repeat("x", 20) + " [a long label here](https://example.com/path) end", 60,
+			"see " + strings.Repeat("x", 20), "[a long label here]"},
+	}
+	for _, tt := range tests {
+		head, tail := Cut(tt.text, tt.max)
+		if n := UTF16Len(head); n > tt.max {
+			t.Errorf("%s: head of %d units, want at most %d", tt.name, n, tt.max)
+		}
+		if !utf8.ValidString(head) || !utf8.ValidString(tail) {
+			t.Errorf("%s: cut inside a rune: %q, %q", tt.name, head, tail)
+		}
+		if tt.head != "" && head != tt.head {
+			t.Errorf("%s: head = %q, want %q", tt.name, head, tt.head)
+		}
+		if !strings.HasPrefix(tail, tt.tail) {
+			t.Errorf("%s: tail = %q, want it to start with %q", tt.name, tail, tt.tail)
+		}
+		for _, part := range []string{head, tail} {
+			if html := ToHTML(part); !entitiesClosed(html) || strings.Contains(html, "**") {
+				t.Errorf("%s: part rendered as %q", tt.name, html)
+			}
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	text := strings.Join([]string{
+		"# Title",
+		"Some **bold text that goes on and on** with a [link](https://example.com) and `code`.",
+		"```python\n" + strings.Repeat("print('hello, world')\n", 10) + "```",
+		"A paragraph with emoji 😀👍🏽 and " + strings.Repeat("more words ", 10),
+		"**" + strings.TrimSpace(strings.Repeat("a bold paragraph longer than a message ", 4)) + "**",
+	}, "\n\n")
+	for _, max := range []int{40, 64, 100, 1000} {
+		parts := Split(text, max)
+		for i, part := range parts {
+			if n := UTF16Len(part); n > max {
+				t.Errorf("max %d: part %d has %d units", max, i, n)
+			}
+			html := ToHTML(part)
+			if !entitiesClosed(html) || strings.Contains(html, "**") {
+				t.Errorf("max %d: part %d rendered as %q", max, i, html)
+			}
+			if strings.Contains(part, "print(") && !strings.Contains(html, `class="language-python"`) {
+				t.Errorf("max %d: code block not reopened with its language in %q", max, part)
+			}
+		}
+		joined := strings.Join(parts, " ")
+		for _, word := range []string{"Title", "link", "😀👍🏽", "message"} {
+			if !strings.Contains(joined, word) {
+				t.Errorf("max %d: %q lost", max, word)
+			}
+		}
+	}
+}
+
+func TestSplitRenderedTable(t *testing.T) {
+	// a long cell pads every row of its column
+	var b strings.Builder
+	b.WriteString("| name | description |\n|---|---|\n")
+	b.WriteString("| " + strings.Repeat("long ", 100) + "| a |\n")
+	for i := 0; i < 100; i++ {
+		b.WriteString("| b | c |\n")
+	}
+	text := b.String()
+	const max = 4096
+	if UTF16Len(text) > max || RenderedLen(text) <= max {
+		t.Fatalf("%d units rendered to %d, want a short text rendered too long",
+			UTF16Len(text), RenderedLen(text))
+	}
+
+	parts := SplitRendered(text, max)
+	if len(parts) < 2 {
+		t.Fatalf("got %d part", len(parts))
+	}
+	for i, part := range parts {
+		if n := RenderedLen(part); n > max {
+			t.Errorf("part %d rendered to %d units", i, n)
+		}
+		if n := UTF16Len(part); n > max {
+			t.Errorf("part %d is %d units", i, n)
+		}
+	}
+	if rows := strings.Count(strings.Join(parts, "\n"), "| b | c |"); rows != 100 {
+		t.Errorf("%d rows after splitting, want 100", rows)
+	}
+}
@@ -0,0 +1,33 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	PRE_PAT  = regexp.MustCompile(`(?s)<pre>.*?</pre>`)
+	TAG_PAT  = regexp.MustCompile(`<[^>]*>`)
+	URL_TEXT = regexp.MustCompile(`\b(?:https?|tg|ftp)://\S+|\bwww\.\S+`)
+	SPACES   = regexp.MustCompile(`[ \t]+`)
+)
+
+// ToSpeech converts Markdown to the plain text to be read aloud: the
+// formatting, code blocks, tables and URLs are removed, and the links are
+// replaced with their labels.
+func ToSpeech(text string) string {
+	text = PRE_PAT.ReplaceAllString(ToHTML(text), "")
+	text = html.UnescapeString(TAG_PAT.ReplaceAllString(text, ""))
+	text = URL_TEXT.ReplaceAllString(text, "")
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(SPACES.ReplaceAllString(line, " "))
+		line = strings.TrimLeft(line, "•☐☑—")
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
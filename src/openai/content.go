@@ -0,0 +1,134 @@
+package openai
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IMAGE_TOKENS is the estimated number of tokens of an image, that of a
+// 1024x1024 image in high detail.
+const IMAGE_TOKENS = 765
+
+// ContentPart is a part of the multi-part content of a message.
+type ContentPart struct {
+	Type     string    `json:"type"` // "text" or "image_url"
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+// MarshalJSON encodes the content of a message with images as a text part
+// followed by an image part for each image.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type message Message // without the methods of Message
+	if len(m.Images) == 0 {
+		return json.Marshal(message(m))
+	}
+	var parts []ContentPart
+	if m.Content != "" {
+		parts = append(parts, ContentPart{Type: "text", Text: m.Content})
+	}
+	for _, url := range m.Images {
+		parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: url}})
+	}
+	return json.Marshal(struct {
+		message
+		Content []ContentPart `json:"content"`
+	}{message(m), parts})
+}
+
+// UnmarshalJSON decodes a message whose content is either a string or a list
+// of parts.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type message Message
+	var msg struct {
+		message
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	*m = Message(msg.message)
+	content := strings.TrimSpace(string(msg.Content))
+	if !strings.HasPrefix(content, "[") {
+		if content == "" || content == "null" {
+			return nil
+		}
+		return json.Unmarshal(msg.Content, &m.Content)
+	}
+
+	var parts []ContentPart
+	if err := json.Unmarshal(msg.Content, &parts); err != nil {
+		return err
+	}
+	var texts []string
+	for _, part := range parts {
+		switch {
+		case part.Type == "text":
+			texts = append(texts, part.Text)
+		case part.Type == "image_url" && part.ImageURL != nil:
+			m.Images = append(m.Images, part.ImageURL.URL)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// isRemote reports whether an image reference is a URL rather than the path
+// of a local file.
+func isRemote(ref string) bool {
+	return strings.HasPrefix(ref, "https://") || strings.HasPrefix(ref, "http://") ||
+		strings.HasPrefix(ref, "data:")
+}
+
+// CheckVision returns an error if a model can't see images.
+func CheckVision(model string) error {
+	if !GetModelInfo(model).Vision {
+		return fmt.Errorf("%s can't see images, switch to a vision model with /model", model)
+	}
+	return nil
+}
+
+// InlineImages returns the messages with their images read from the local
+// files they refer to and inlined as base64 data URLs, as the API requires.
+// The images are removed if the model can't see them, or if their file is
+// missing.
+func InlineImages(messages []Message, vision bool) []Message {
+	inlined := make([]Message, len(messages))
+	for i, msg := range messages {
+		images := msg.Images
+		msg.Images = nil
+		if !vision {
+			inlined[i] = msg
+			continue
+		}
+		for _, ref := range images {
+			if isRemote(ref) {
+				msg.Images = append(msg.Images, ref)
+				continue
+			}
+			data, err := os.ReadFile(ref)
+			if err != nil {
+				log.Printf("Couldn't read image: %v", err)
+				continue
+			}
+			typ := mime.TypeByExtension(filepath.Ext(ref))
+			if typ == "" {
+				typ = "image/jpeg"
+			}
+			msg.Images = append(msg.Images,
+				"data:"+typ+";base64,"+base64.StdEncoding.EncodeToString(data))
+		}
+		inlined[i] = msg
+	}
+	return inlined
+}
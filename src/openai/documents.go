@@ -0,0 +1,264 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/tztsai/openai-telegram/src/docs"
+	"github.com/tztsai/openai-telegram/src/tokenizer"
+)
+
+// RETRIEVED_CHUNKS is the number of chunks of an indexed document included
+// in a request.
+const RETRIEVED_CHUNKS = 4
+
+const DOCUMENTS_HEADER = "Documents attached by the user:\n\n"
+
+// CUT_MARKER ends a document trimmed to fit in the context.
+const CUT_MARKER = "\n\n[...]"
+
+// Document is a document attached to a conversation. Its text is kept in an
+// index file rather than in the conversation.
+type Document struct {
+	Name    string
+	Path    string // of its index
+	Tokens  int
+	Indexed bool // only its chunks relevant to the last message are included
+}
+
+func (d Document) String() string {
+	if d.Indexed {
+		return fmt.Sprintf("📄 %s: %d tokens, searched for each message", d.Name, d.Tokens)
+	}
+	return fmt.Sprintf("📄 %s: %d tokens, included in the conversation", d.Name, d.Tokens)
+}
+
+// AddDocument converts a file to text and attaches it to a conversation,
+// replacing the document of the same name if any. The documents longer than
+// DocInjectTokens are indexed, so that only their parts relevant to the
+// conversation are included in the requests.
+func (c *GPT4) AddDocument(ctx context.Context, tgChatID int64, path string, name string) (Document, error) {
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	text, err := docs.Extract(ctx, path, name, c.PDFToText)
+	if err != nil {
+		return Document{}, err
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return Document{}, errors.New("no text found in the document")
+	}
+
+	doc := Document{Name: name, Tokens: len(text) / 4}
+	info := GetModelInfo(c.GetConversation(tgChatID).Settings.Model)
+	if enc, err := tokenizer.Get(info.Encoding); err == nil {
+		doc.Tokens = enc.Count(text)
+	}
+	index := &docs.Index{Name: name, Chunks: []string{text}}
+	if doc.Tokens > c.DocInjectTokens {
+		index.Chunks = docs.Chunk(text)
+		if index.Embeddings, err = c.Embedder.Embed(ctx, index.Chunks); err != nil {
+			return Document{}, fmt.Errorf("couldn't index the document: %v", err)
+		}
+		doc.Indexed = true
+	}
+	if doc.Path, err = index.Save(docs.DOCS_DIR); err != nil {
+		return Document{}, err
+	}
+
+	c.UpdateConversation(tgChatID, func(convo *Conversation) {
+		for i, d := range convo.Documents {
+			if d.Name == name {
+				os.Remove(d.Path)
+				convo.Documents = append(convo.Documents[:i], convo.Documents[i+1:]...)
+				break
+			}
+		}
+		convo.Documents = append(convo.Documents, doc)
+	})
+	return doc, nil
+}
+
+// ForgetDocument removes a document, given by its name or number, from a
+// conversation. It returns false if there is none.
+func (c *GPT4) ForgetDocument(tgChatID int64, name string) (Document, bool) {
+	var doc Document
+	found := false
+	c.UpdateConversation(tgChatID, func(convo *Conversation) {
+		for i, d := range convo.Documents {
+			if d.Name == name || strconv.Itoa(i+1) == name {
+				doc, found = d, true
+				convo.Documents = append(convo.Documents[:i], convo.Documents[i+1:]...)
+				return
+			}
+		}
+	})
+	if found {
+		if err := os.Remove(doc.Path); err != nil {
+			log.Printf("Couldn't remove document: %v", err)
+		}
+	}
+	return doc, found
+}
+
+// queryCache keeps the embedding of the last user message of each chat, so
+// that it is computed once per user turn rather than for each tool round.
+type queryCache struct {
+	mu      sync.Mutex
+	queries map[int64]cachedQuery
+}
+
+type cachedQuery struct {
+	text      string
+	embedding []float32
+}
+
+// embedding returns the embedding of the last user message of a chat.
+func (q *queryCache) embedding(ctx context.Context, embedder *docs.Embedder, chatID int64, text string) ([]float32, error) {
+	q.mu.Lock()
+	cached, ok := q.queries[chatID]
+	q.mu.Unlock()
+	if ok && cached.text == text {
+		return cached.embedding, nil
+	}
+	embeddings, err := embedder.Embed(ctx, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queries == nil {
+		q.queries = make(map[int64]cachedQuery)
+	}
+	q.queries[chatID] = cachedQuery{text, embeddings[0]}
+	return embeddings[0], nil
+}
+
+// WithDocuments inserts the documents of a conversation after its leading
+// system messages: the whole text of the short documents, and the chunks of
+// the indexed documents most relevant to the last user message. The
+// documents are trimmed to fit in the context of the model along with the
+// messages that FitContext keeps, and take at most half of it.
+func (c *GPT4) WithDocuments(ctx context.Context, chatID int64, convo Conversation, messages []Message, tools []Tool) []Message {
+	documents := convo.Documents
+	if len(documents) == 0 {
+		return messages
+	}
+	indexed := false
+	for _, d := range documents {
+		indexed = indexed || d.Indexed
+	}
+	var query []float32 // embedding of the last user message
+	last := lastUserMessage(messages)
+	if indexed && last >= 0 && messages[last].Content != "" {
+		var err error
+		query, err = c.queries.embedding(ctx, c.Embedder, chatID, messages[last].Content)
+		if err != nil {
+			log.Printf("Couldn't embed message: %v", err)
+		}
+	}
+
+	var parts []string
+	for _, d := range documents {
+		index, err := docs.LoadIndex(d.Path)
+		if err != nil {
+			log.Printf("Couldn't load document %s: %v", d.Name, err)
+			continue
+		}
+		if d.Indexed {
+			chunks := index.Search(query, RETRIEVED_CHUNKS)
+			parts = append(parts, fmt.Sprintf("# %s (excerpts)\n\n%s", d.Name, strings.Join(chunks, "\n\n[...]\n\n")))
+		} else {
+			parts = append(parts, fmt.Sprintf("# %s\n\n%s", d.Name, strings.Join(index.Chunks, "\n\n")))
+		}
+	}
+	if len(parts) == 0 {
+		return messages
+	}
+
+	i := 0
+	for i < len(messages) && messages[i].Role == "system" {
+		i++
+	}
+	info := GetModelInfo(convo.Settings.Model)
+	enc, err := tokenizer.Get(info.Encoding)
+	if err != nil {
+		log.Printf("Couldn't load tokenizer: %v", err)
+		return messages
+	}
+	maxTokens := convo.Settings.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = RESERVED_TOKENS
+	}
+	// the messages that FitContext never drops: the system messages and the
+	// last user message with the tool calls answering it
+	kept := messages[:i]
+	if last >= i {
+		kept = append(append([]Message(nil), kept...), messages[last:]...)
+	}
+	budget := info.ContextSize - maxTokens
+	if available := budget - CountTokens(enc, kept, tools); available < budget/2 {
+		budget = available
+	} else {
+		budget /= 2
+	}
+	limit := budget - MessageTokens(enc, Message{Role: "system", Content: DOCUMENTS_HEADER})
+	content, trimmed := fitDocuments(enc, parts, limit)
+	// the tokens can merge across the joints of the parts
+	over := MessageTokens(enc, Message{Role: "system", Content: DOCUMENTS_HEADER + content}) - budget
+	if trimmed && over > 0 {
+		content, _ = fitDocuments(enc, parts, limit-over)
+	}
+	if trimmed {
+		log.Printf("Trimmed the documents of chat %d to %d tokens", chatID, budget)
+	}
+	if content == "" {
+		return messages
+	}
+
+	result := make([]Message, 0, len(messages)+1)
+	result = append(result, messages[:i]...)
+	result = append(result, Message{Role: "system", Content: DOCUMENTS_HEADER + content})
+	return append(result, messages[i:]...)
+}
+
+// fitDocuments joins the parts of the documents, cutting the end of the
+// first part that exceeds the budget of tokens and dropping the rest. It
+// returns whether the parts were trimmed.
+func fitDocuments(enc *tokenizer.Encoding, parts []string, budget int) (string, bool) {
+	var b strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			part = "\n\n" + part
+		}
+		tokens := enc.Count(part)
+		if tokens <= budget {
+			b.WriteString(part)
+			budget -= tokens
+			continue
+		}
+		// the longest prefix of the part that fits with the cut marker, cut
+		// at a rune
+		n := sort.Search(len(part)+1, func(n int) bool {
+			return enc.Count(part[:n]+CUT_MARKER) > budget
+		}) - 1
+		for n > 0 && !utf8.RuneStart(part[n]) {
+			n--
+		}
+		if n > 0 {
+			b.WriteString(part[:n] + CUT_MARKER)
+		}
+		return strings.TrimSpace(b.String()), true
+	}
+	return b.String(), false
+}
@@ -0,0 +1,125 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tztsai/openai-telegram/src/docs"
+	"github.com/tztsai/openai-telegram/src/tokenizer"
+)
+
+// embeddingServer serves embeddings of a single dimension and counts the
+// texts embedded.
+func embeddingServer(t *testing.T, embedded *int32) *docs.Embedder {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Input []string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		atomic.AddInt32(embedded, int32(len(req.Input)))
+		var res embeddingResponse
+		for i := range req.Input {
+			res.Data = append(res.Data, embeddingData{Index: i, Embedding: []float32{1}})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(server.Close)
+	return &docs.Embedder{URL: server.URL, Model: "test"}
+}
+
+type embeddingData struct {
+	Index     int       `json:"index"`
+	Embedding []float32 `json:"embedding"`
+}
+
+type embeddingResponse struct {
+	Data []embeddingData `json:"data"`
+}
+
+func saveDocument(t *testing.T, name string, chunks []string, indexed bool) Document {
+	index := &docs.Index{Name: name, Chunks: chunks}
+	if indexed {
+		for range chunks {
+			index.Embeddings = append(index.Embeddings, []float32{1})
+		}
+	}
+	path, err := index.Save(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Document{Name: name, Path: path, Indexed: indexed}
+}
+
+func TestWithDocumentsEmbedsOncePerTurn(t *testing.T) {
+	var embedded int32
+	c := &GPT4{Embedder: embeddingServer(t, &embedded)}
+	convo := Conversation{
+		Settings:  Settings{Model: "gpt-4o"},
+		Documents: []Document{saveDocument(t, "manual", []string{"one", "two"}, true)},
+	}
+	messages := []Message{
+		{Role: "system", Content: "prompt"},
+		{Role: "user", Content: "what does it say?"},
+	}
+
+	result := c.WithDocuments(context.Background(), 1, convo, messages, nil)
+	if len(result) != 3 || result[1].Role != "system" || !strings.Contains(result[1].Content, "one") {
+		t.Fatalf("documents not inserted after the system prompt: %+v", result)
+	}
+	// the tool rounds of the same turn reuse the embedding
+	messages = append(messages,
+		Message{Role: "assistant", ToolCalls: []ToolCall{{ID: "1"}}},
+		Message{Role: "tool", ToolCallID: "1", Content: "result"})
+	c.WithDocuments(context.Background(), 1, convo, messages, nil)
+	if embedded != 1 {
+		t.Errorf("embedded %d messages in one turn, want 1", embedded)
+	}
+
+	messages = append(messages, Message{Role: "user", Content: "and then?"})
+	c.WithDocuments(context.Background(), 1, convo, messages, nil)
+	c.WithDocuments(context.Background(), 2, convo, messages, nil)
+	if embedded != 3 {
+		t.Errorf("embedded %d messages in three turns, want 3", embedded)
+	}
+}
+
+func TestWithDocumentsFitsContext(t *testing.T) {
+	c := &GPT4{}
+	long := strings.Repeat("All work and no play makes Jack a dull boy. ", 1000)
+	convo := Conversation{
+		Settings: Settings{Model: "gpt-4", MaxTokens: 1000},
+		Documents: []Document{
+			saveDocument(t, "short", []string{"A short note."}, false),
+			saveDocument(t, "long", []string{long}, false),
+			saveDocument(t, "dropped", []string{"Never included."}, false),
+		},
+	}
+	messages := []Message{
+		{Role: "system", Content: "prompt"},
+		{Role: "user", Content: strings.Repeat("word ", 5000)},
+	}
+	result := c.WithDocuments(context.Background(), 1, convo, messages, nil)
+	if len(result) != 3 {
+		t.Fatalf("got %d messages, want 3", len(result))
+	}
+	content := result[1].Content
+	if !strings.Contains(content, "A short note.") || !strings.Contains(content, "# long") ||
+		strings.Contains(content, "Never included.") {
+		t.Errorf("documents trimmed in the wrong order: %.100q...", content)
+	}
+
+	enc, _ := tokenizer.Get(tokenizer.CL100K_BASE)
+	if n := CountTokens(enc, result, nil); n > 8192-1000 {
+		t.Errorf("%d tokens don't fit in the context", n)
+	}
+	// the documents take at most half of the context of short conversations
+	result = c.WithDocuments(context.Background(), 1, convo, messages[:1], nil)
+	if n := MessageTokens(enc, result[1]); n > (8192-1000)/2 {
+		t.Errorf("documents take %d tokens", n)
+	}
+}
@@ -0,0 +1,136 @@
+package openai
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/tztsai/openai-telegram/src/tokenizer"
+)
+
+// RESERVED_TOKENS is the room left for the completion when max_tokens is not
+// set.
+const RESERVED_TOKENS = 1000
+
+type ModelInfo struct {
+	Prefix      string
+	ContextSize int
+	Encoding    string
+	Vision      bool // whether the model accepts images
+}
+
+// MODELS is matched by the longest prefix of a model name.
+var MODELS = []ModelInfo{
+	{"gpt-5", 400000, tokenizer.O200K_BASE, true},
+	{"gpt-4.1", 1047576, tokenizer.O200K_BASE, true},
+	{"gpt-4o", 128000, tokenizer.O200K_BASE, true},
+	{"gpt-4-turbo", 128000, tokenizer.CL100K_BASE, true},
+	{"gpt-4-1106", 128000, tokenizer.CL100K_BASE, false},
+	{"gpt-4-0125", 128000, tokenizer.CL100K_BASE, false},
+	{"gpt-4-32k", 32768, tokenizer.CL100K_BASE, false},
+	{"gpt-4", 8192, tokenizer.CL100K_BASE, false},
+	{"gpt-3.5-turbo-instruct", 4096, tokenizer.CL100K_BASE, false},
+	{"gpt-3.5-turbo", 16385, tokenizer.CL100K_BASE, false},
+	{"o1", 200000, tokenizer.O200K_BASE, true},
+	{"o1-mini", 128000, tokenizer.O200K_BASE, false},
+	{"o3", 200000, tokenizer.O200K_BASE, true},
+	{"o3-mini", 200000, tokenizer.O200K_BASE, false},
+	{"o4", 200000, tokenizer.O200K_BASE, true},
+}
+
+var DEFAULT_MODEL_INFO = ModelInfo{"", 8192, tokenizer.CL100K_BASE, false}
+
+func GetModelInfo(model string) ModelInfo {
+	info := DEFAULT_MODEL_INFO
+	for _, m := range MODELS {
+		if strings.HasPrefix(model, m.Prefix) && len(m.Prefix) > len(info.Prefix) {
+			info = m
+		}
+	}
+	return info
+}
+
+// CountTokens counts the prompt tokens of a request as the API does: each
+// message is wrapped in 3 special tokens and the reply is primed with 3 more.
+func CountTokens(enc *tokenizer.Encoding, messages []Message, tools []Tool) int {
+	n := 3
+	for _, msg := range messages {
+		n += MessageTokens(enc, msg)
+	}
+	if len(tools) > 0 {
+		data, _ := json.Marshal(tools)
+		n += enc.Count(string(data))
+	}
+	return n
+}
+
+func MessageTokens(enc *tokenizer.Encoding, msg Message) int {
+	n := 3 + enc.Count(msg.Role) + enc.Count(msg.Content) + IMAGE_TOKENS*len(msg.Images)
+	for _, call := range msg.ToolCalls {
+		n += 3 + enc.Count(call.Function.Name) + enc.Count(call.Function.Arguments)
+	}
+	return n
+}
+
+// FitContext returns the messages that fit in the context window of a model,
+// leaving maxTokens (or RESERVED_TOKENS if 0) for the completion. The
+// earliest messages are dropped first, except system messages and the last
+// message with its tool calls; a tool call is dropped with its results.
+func FitContext(model string, maxTokens int, messages []Message, tools []Tool) []Message {
+	info := GetModelInfo(model)
+	enc, err := tokenizer.Get(info.Encoding)
+	if err != nil {
+		log.Printf("Couldn't load tokenizer: %v", err)
+		return messages
+	}
+	if maxTokens <= 0 {
+		maxTokens = RESERVED_TOKENS
+	}
+	budget := info.ContextSize - maxTokens
+
+	tokens := make([]int, len(messages))
+	total := CountTokens(enc, nil, tools)
+	for i, msg := range messages {
+		tokens[i] = MessageTokens(enc, msg)
+		total += tokens[i]
+	}
+
+	last := len(messages) - 1
+	for last > 0 && messages[last].Role == "tool" {
+		last--
+	}
+
+	keep := make([]bool, len(messages))
+	for i := range keep {
+		keep[i] = true
+	}
+	dropped := 0
+	for i := 0; i < last && total > budget; i++ {
+		if messages[i].Role == "system" || !keep[i] {
+			continue
+		}
+		keep[i] = false
+		total -= tokens[i]
+		dropped++
+		// drop the results of the dropped tool calls
+		for j := i + 1; j < last && messages[j].Role == "tool"; j++ {
+			keep[j] = false
+			total -= tokens[j]
+			dropped++
+		}
+	}
+
+	if dropped == 0 {
+		return messages
+	}
+	log.Printf("Dropped %d earliest messages to fit %d tokens in the context of %s",
+		dropped, total, model)
+
+	fitted := make([]Message, 0, len(messages)-dropped)
+	for i, msg := range messages {
+		if keep[i] {
+			fitted = append(fitted, msg)
+		}
+	}
+	return fitted
+}
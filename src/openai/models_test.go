@@ -0,0 +1,70 @@
+package openai
+
+import (
+	"testing"
+
+	"github.com/tztsai/openai-telegram/src/tokenizer"
+)
+
+func TestGetModelInfo(t *testing.T) {
+	tests := []struct {
+		model       string
+		contextSize int
+		encoding    string
+		vision      bool
+	}{
+		{"gpt-4", 8192, tokenizer.CL100K_BASE, false},
+		{"gpt-4-0613", 8192, tokenizer.CL100K_BASE, false},
+		{"gpt-4-32k-0613", 32768, tokenizer.CL100K_BASE, false},
+		{"gpt-4-1106-preview", 128000, tokenizer.CL100K_BASE, false},
+		{"gpt-4-turbo-2024-04-09", 128000, tokenizer.CL100K_BASE, true},
+		{"gpt-4o", 128000, tokenizer.O200K_BASE, true},
+		{"gpt-4o-mini", 128000, tokenizer.O200K_BASE, true},
+		{"gpt-4.1-nano", 1047576, tokenizer.O200K_BASE, true},
+		{"gpt-5", 400000, tokenizer.O200K_BASE, true},
+		{"gpt-3.5-turbo", 16385, tokenizer.CL100K_BASE, false},
+		{"gpt-3.5-turbo-instruct", 4096, tokenizer.CL100K_BASE, false},
+		{"o1", 200000, tokenizer.O200K_BASE, true},
+		{"o1-mini", 128000, tokenizer.O200K_BASE, false},
+		{"o3-mini", 200000, tokenizer.O200K_BASE, false},
+		{"o4-mini", 200000, tokenizer.O200K_BASE, true},
+		{"unknown-model", 8192, tokenizer.CL100K_BASE, false},
+	}
+	for _, tt := range tests {
+		info := GetModelInfo(tt.model)
+		if info.ContextSize != tt.contextSize || info.Encoding != tt.encoding || info.Vision != tt.vision {
+			t.Errorf("GetModelInfo(%q) = %+v, want %d tokens of %s, vision %v",
+				tt.model, info, tt.contextSize, tt.encoding, tt.vision)
+		}
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	enc, err := tokenizer.Get(tokenizer.CL100K_BASE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "system", "user", "assistant" and "tool" are single tokens, and
+	// "hello world" is 2 tokens
+	messages := []Message{
+		{Role: "system", Content: "hello world"},
+		{Role: "user", Content: "hello world", Images: []string{"photo.jpg"}},
+		{Role: "assistant", ToolCalls: []ToolCall{{
+			ID:       "1",
+			Type:     "function",
+			Function: FunctionCall{Name: "hello", Arguments: "world"},
+		}}},
+		{Role: "tool", ToolCallID: "1", Content: "hello world"},
+	}
+	want := 3 + // priming of the reply
+		(3 + 1 + 2) +
+		(3 + 1 + 2 + IMAGE_TOKENS) +
+		(3 + 1 + 0 + (3 + 1 + 1)) +
+		(3 + 1 + 2)
+	if n := CountTokens(enc, messages, nil); n != want {
+		t.Errorf("CountTokens = %d, want %d", n, want)
+	}
+	if n := CountTokens(enc, nil, nil); n != 3 {
+		t.Errorf("CountTokens of no messages = %d, want 3", n)
+	}
+}
@@ -1,7 +1,9 @@
 package openai
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,46 +13,92 @@ import (
 
 	"github.com/tztsai/openai-telegram/src/bing"
 	"github.com/tztsai/openai-telegram/src/config"
+	"github.com/tztsai/openai-telegram/src/docs"
+	"github.com/tztsai/openai-telegram/src/imagegen"
+	"github.com/tztsai/openai-telegram/src/plugin"
 	"github.com/tztsai/openai-telegram/src/sse"
 	"github.com/tztsai/openai-telegram/src/subproc"
+	"github.com/tztsai/openai-telegram/src/web"
 	"github.com/tztsai/openai-telegram/src/wolfram"
 )
 
 const OPENAI_API_URL = "https://api.openai.com/v1/chat/completions"
 const USER_AGENT = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0.0.0 Safari/537.36"
 
-const MAX_TOKENS = 8192
-const MESSAGE_MAX_LENGTH = 4096
-
 const QUERY_FAILED = "Query failed. Try another query or plugin."
 
+const STOPPED = "ℹ️ Stopped."
+
+// CONTINUE_PROMPT asks the model to continue its last answer.
+const CONTINUE_PROMPT = "Continue your last answer from where it stopped, without repeating it."
+
+var QUERY_PAT = regexp.MustCompile(`🤖\s*I ask (\w+)\s+([\s\S]*)`)
+
 type Conversation struct {
 	Messages    []Message
 	TotalTokens int
 	Verbose     bool
+	Voice       bool // whether the answers are also sent as voice notes
 	Time        time.Time
+	Settings    Settings
+	Summary     string    // summary of the archived messages
+	Archive     []Message // messages replaced by the summary
+	// group chat of a thread conversation, and IDs of the Telegram messages
+	// of the thread, starting with its root
+	ChatID    int64      `json:",omitempty"`
+	Thread    []int      `json:",omitempty"`
+	Documents []Document `json:",omitempty"` // attached by the user
 }
 
 type GPT4 struct {
-	ModelName     string
 	SessionToken  string
-	Conversations map[int64]Conversation
-	Temperature   float32
-	Bing          *bing.API
-	Wolfram       *wolfram.API
-	Python        *subproc.Subproc
-	// Shell         *subproc.Subproc
+	Conversations *ConversationStore
+	Defaults      Settings // settings of new conversations
+	LegacyPlugins bool     // ask plugins in text instead of calling tools
+	// conversations longer than this number of tokens get their earlier
+	// messages summarized, 0 to disable
+	SummaryThreshold int
+	Plugins          *plugin.Registry
+	Python           *subproc.PythonPool
+	Embedder         *docs.Embedder
+	PDFToText        string // pdftotext executable converting PDF documents
+	// documents longer than this number of tokens are indexed and searched
+	// rather than included whole
+	DocInjectTokens int
+	queries         queryCache
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	Images     []string   `json:"-"` // paths or URLs of the images attached
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+// Delta is the change of a message in a streamed response.
+type Delta struct {
+	Role      string          `json:"role"`
+	Content   string          `json:"content"`
+	ToolCalls []ToolCallDelta `json:"tool_calls"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type Request struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Temperature float32   `json:"temperature"`
+	Settings
+	Messages      []Message      `json:"messages"`
+	Tools         []Tool         `json:"tools,omitempty"`
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 type MessageResponse struct {
@@ -58,11 +106,7 @@ type MessageResponse struct {
 	Object  string `json:"object"`
 	Created int    `json:"created"`
 	Model   string `json:"model"`
-	Usage   struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
+	Usage   Usage  `json:"usage"`
 	Choices []struct {
 		Message      Message `json:"message"`
 		FinishReason string  `json:"finish_reason"`
@@ -70,69 +114,154 @@ type MessageResponse struct {
 	} `json:"choices"`
 }
 
+// StreamResponse is a chunk of a streamed chat completion. Usage is only
+// present in the last chunk, which has no choices.
+type StreamResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int    `json:"created"`
+	Model   string `json:"model"`
+	Usage   *Usage `json:"usage"`
+	Choices []struct {
+		Delta        Delta  `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+		Index        int    `json:"index"`
+	} `json:"choices"`
+}
+
 func Init(config *config.EnvConfig) *GPT4 {
-	return &GPT4{
-		ModelName:     config.DefaultModel,
-		SessionToken:  config.OpenAIKey,
-		Conversations: make(map[int64]Conversation),
-		Temperature:   1.0,
-		Bing:          bing.Init(config),
-		Wolfram:       wolfram.Init(config),
-		Python:        subproc.Init(config.PythonPath, "src/subproc/console.py"),
+	python := subproc.NewPythonPool(config.PythonPath, subproc.Sandbox{
+		Timeout:   time.Duration(config.PythonTimeout) * time.Second,
+		CPUTime:   time.Duration(config.PythonCPUTime) * time.Second,
+		Memory:    config.PythonMemory,
+		MaxOutput: config.PythonMaxOutput,
+		NoNetwork: config.PythonNoNetwork,
+		NoFiles:   config.PythonNoFiles,
+	}, time.Duration(config.PythonSessionTTL)*time.Minute, config.PythonMaxSessions)
+	c := &GPT4{
+		SessionToken: config.OpenAIKey,
+		Defaults: Settings{
+			Model:       config.DefaultModel,
+			Temperature: 1.0,
+		},
+		LegacyPlugins:    config.LegacyPlugins,
+		SummaryThreshold: config.SummaryThreshold,
+		Plugins: plugin.NewRegistry(
+			python,
+			bing.Init(config),
+			wolfram.Init(config),
+			web.Init(),
+			imagegen.Init(config),
+			subproc.NewShell(config.ShellCommands,
+				time.Duration(config.ShellTimeout)*time.Second,
+				config.ShellMemory, config.ShellTool),
+		),
+		Python: python,
+		Embedder: &docs.Embedder{
+			URL:   docs.EMBEDDINGS_URL,
+			Key:   config.OpenAIKey,
+			Model: config.EmbeddingModel,
+		},
+		PDFToText:       config.PDFToTextPath,
+		DocInjectTokens: config.DocInjectTokens,
 	}
+	c.Conversations = NewConversationStore(c.NewConversation)
+	return c
 }
 
 func (c *GPT4) Close() {
 	log.Println("Closing GPT4 client...")
-	go c.Python.Close()
+	c.Python.Close() // before exiting, so that the interpreters are stopped
+	if err := c.Conversations.Close(); err != nil {
+		log.Printf("Couldn't close conversation storage: %v", err)
+	}
+}
+
+func (c *GPT4) NewConversation() Conversation {
+	return Conversation{
+		Time:     time.Now(),
+		Settings: c.Defaults,
+	}
 }
 
+// ResetConversation clears the messages of a conversation but keeps its
+// settings, thread and documents.
 func (c *GPT4) ResetConversation(chatID int64) {
-	delete(c.Conversations, chatID)
+	c.UpdateConversation(chatID, func(convo *Conversation) {
+		*convo = Conversation{
+			Time:      time.Now(),
+			Settings:  convo.Settings,
+			Voice:     convo.Voice,
+			ChatID:    convo.ChatID,
+			Thread:    convo.Thread,
+			Documents: convo.Documents,
+		}
+	})
 }
 
 func (c *GPT4) GetConversation(chatID int64) Conversation {
-	convo, ok := c.Conversations[chatID]
-	if !ok {
-		convo.Time = time.Now()
-		c.Conversations[chatID] = convo
+	if convo, ok := c.Conversations.Get(chatID); ok {
+		return convo
 	}
-	return convo
+	return c.Conversations.Update(chatID, func(convo *Conversation) {})
+}
+
+func (c *GPT4) UpdateConversation(chatID int64, update func(convo *Conversation)) Conversation {
+	return c.Conversations.Update(chatID, update)
+}
+
+func (c *GPT4) SetSettings(chatID int64, settings Settings) {
+	c.UpdateConversation(chatID, func(convo *Conversation) {
+		convo.Settings = settings
+	})
+}
+
+// AddToThread records Telegram messages as part of the thread of a
+// conversation.
+func (c *GPT4) AddToThread(chatID int64, messageIDs ...int) {
+	c.UpdateConversation(chatID, func(convo *Conversation) {
+		convo.Thread = append(convo.Thread, messageIDs...)
+	})
 }
 
 func (c *GPT4) AddMessage(chatID int64, message string, role string, tokens int) Conversation {
-	convo := c.GetConversation(chatID)
 	// message = strings.ReplaceAll(message, "{", "\\{")
 	// message = strings.ReplaceAll(message, "}", "\\}")
-	convo.Messages = append(convo.Messages, Message{Role: role, Content: message})
-	if tokens > 0 {
-		convo.TotalTokens = tokens
-	}
-	c.Conversations[chatID] = convo
-	return convo
+	return c.AppendMessage(chatID, Message{Role: role, Content: message}, tokens)
+}
+
+func (c *GPT4) AppendMessage(chatID int64, message Message, tokens int) Conversation {
+	return c.UpdateConversation(chatID, func(convo *Conversation) {
+		convo.Messages = append(convo.Messages, message)
+		if tokens > 0 {
+			convo.TotalTokens = tokens
+		}
+	})
 }
 
 func (c *GPT4) DelMessage(chatID int64, index int) Conversation {
-	convo := c.GetConversation(chatID)
-	if index < 0 {
-		index = len(convo.Messages) + index
-	}
-	convo.Messages = append(convo.Messages[:index], convo.Messages[index+1:]...)
-	c.Conversations[chatID] = convo
-	return convo
+	return c.UpdateConversation(chatID, func(convo *Conversation) {
+		if index < 0 {
+			index = len(convo.Messages) + index
+		}
+		if index < 0 || index >= len(convo.Messages) {
+			return
+		}
+		convo.Messages = append(convo.Messages[:index], convo.Messages[index+1:]...)
+	})
 }
 
 func (t *Conversation) GetConversationInfo() string {
-	return fmt.Sprintf("Length: %d  Tokens: %d  Duration: %.0f s",
+	info := fmt.Sprintf("Length: %d  Tokens: %d  Duration: %.0f s",
 		len(t.Messages), t.TotalTokens, time.Since(t.Time).Seconds())
+	if len(t.Archive) > 0 {
+		info += fmt.Sprintf("  Summarized: %d", len(t.Archive))
+	}
+	return info
 }
 
 func (c *GPT4) GetChatIDs() []int64 {
-	keys := make([]int64, 0, len(c.Conversations))
-	for k := range c.Conversations {
-		keys = append(keys, k)
-	}
-	return keys
+	return c.Conversations.ChatIDs()
 }
 
 func (c *GPT4) InitClient(url string) sse.Client {
@@ -147,75 +276,104 @@ func (c *GPT4) InitClient(url string) sse.Client {
 	return client
 }
 
-func (c *GPT4) SendRequest(client sse.Client, chatID int64) error {
+// SendRequest sends the conversation of a chat to GPT4, dropping its
+// earliest messages if it doesn't fit in the context window of the model.
+func (c *GPT4) SendRequest(ctx context.Context, client sse.Client, chatID int64) error {
+	convo := c.GetConversation(chatID)
 	req := Request{
-		Model:       c.ModelName,
-		Messages:    c.GetConversation(chatID).Messages,
-		Temperature: c.Temperature,
+		Settings: convo.Settings,
+		Stream:   true,
+		StreamOptions: &StreamOptions{
+			IncludeUsage: true,
+		},
 	}
-	err := client.Connect("POST", map[string]string{}, req)
-	if err != nil {
+	if !c.LegacyPlugins {
+		req.Tools = c.Tools(ctx)
+	}
+	messages := WithSummary(convo.Messages, convo.Summary)
+	messages = c.WithDocuments(ctx, chatID, convo, messages, req.Tools)
+	messages = FitContext(convo.Settings.Model, convo.Settings.MaxTokens, messages, req.Tools)
+	req.Messages = InlineImages(messages, GetModelInfo(convo.Settings.Model).Vision)
+	err := client.Connect(ctx, "POST", map[string]string{}, req)
+	if err != nil && ctx.Err() == nil {
 		log.Println(err)
 	}
 	return err
 }
 
-func (c *GPT4) SendRequestAvoidTokensExceeded(client sse.Client, chatID int64, retries int) error {
-	var err error
-	var convo = c.GetConversation(chatID)
-
-	if convo.TotalTokens > MAX_TOKENS-1000 {
-		log.Println("Conversation getting too long, deleted earliest responses")
-		// delete at most 2 GPT's responses before 6 messages ago
-		for i, j := 0, 0; i < len(convo.Messages)-6 && j < 2; i++ {
-			if convo.Messages[i].Role == "assistant" {
-				convo = c.DelMessage(chatID, i)
-				j++
-			}
-		}
-	}
-
-	for tries := 1; len(convo.Messages) > 0; tries++ {
-		// send HTTP POST request
-		if err = c.SendRequest(client, chatID); err != nil {
-			// maybe max tokens exceeded, delete earliest messages and try again
-			if tries < retries && strings.Contains(err.Error(), "400 Bad Request") {
-
-				log.Println(convo.GetConversationInfo())
-
-				var i int
-				for i = 0; i < 3 && i < len(convo.Messages); i++ {
-					if convo.Messages[i].Role != "system" {
-						break
-					}
-				} // try to avoid deleting system messages
-				convo = c.DelMessage(chatID, i)
-
-				log.Println("Max tokens exceeded, deleted earliest messages")
-			} else {
-				return err
-			}
-		} else {
-			return nil
+func (c *GPT4) SendSingleMessage(message string) chan sse.Chunk {
+	feed := make(chan sse.Chunk)
+	go func() {
+		defer close(feed)
+		if len(message) > 0 {
+			feed <- sse.Chunk{Text: message}
 		}
-	}
-	return err
+	}()
+	return feed
 }
 
-func (c *GPT4) SendSingleMessage(message string) chan string {
-	feed := make(chan string)
+// SendResult feeds the result of a plugin to the user.
+func (c *GPT4) SendResult(res plugin.Result) chan sse.Chunk {
+	feed := make(chan sse.Chunk)
 	go func() {
 		defer close(feed)
-		if len(message) > 0 {
-			feed <- message
+		if len(res.Text) > 0 {
+			feed <- sse.Chunk{Text: res.Text}
 		}
+		FeedAttachments(res, feed)
 	}()
 	return feed
 }
 
-func (c *GPT4) SendMessage(message string, tgChatID int64) (chan string, error) {
+// ReadStream forwards the content deltas of a streamed completion to feed as
+// a single message and returns the assembled message and token usage. If ctx
+// is cancelled, the message received so far is returned with ctx.Err().
+func (c *GPT4) ReadStream(ctx context.Context, client sse.Client, feed chan sse.Chunk) (Message, Usage, error) {
+	var text strings.Builder
+	var usage Usage
+	var msg = Message{Role: "assistant"}
+
+	for event := range client.EventChannel {
+		var res StreamResponse
+		if err := json.Unmarshal([]byte(event.Data), &res); err != nil {
+			log.Printf("Couldn't unmarshal stream response: %v", err)
+			return msg, usage, fmt.Errorf("failed to decode response from GPT4")
+		}
+		if res.Usage != nil {
+			usage = *res.Usage
+		}
+		if len(res.Choices) == 0 {
+			continue
+		}
+		delta := res.Choices[0].Delta
+		for _, d := range delta.ToolCalls {
+			msg.ToolCalls = d.MergeInto(msg.ToolCalls)
+		}
+		content := strings.ReplaceAll(delta.Content, "\r\n", "\n")
+		if len(content) == 0 {
+			continue
+		}
+		feed <- sse.Chunk{Text: content, Append: text.Len() > 0}
+		text.WriteString(content)
+	}
+
+	msg.Content = text.String()
+	if err := ctx.Err(); err != nil {
+		return msg, usage, err
+	}
+	if len(msg.Content) == 0 && len(msg.ToolCalls) == 0 {
+		return msg, usage, fmt.Errorf("no response from GPT4")
+	}
+	return msg, usage, nil
+}
+
+// SendMessage adds a message to a conversation, with the images at the given
+// paths if any, and returns a feed of the response. Cancelling ctx stops the
+// response, keeping the part of it received so far in the conversation.
+func (c *GPT4) SendMessage(ctx context.Context, message string, tgChatID int64, images ...string) (chan sse.Chunk, error) {
 	var role string
-	var err error
+
+	ctx = plugin.WithChatID(ctx, tgChatID)
 
 	message = strings.TrimSpace(message)
 	if strings.HasPrefix(message, "/system ") {
@@ -226,192 +384,264 @@ func (c *GPT4) SendMessage(message string, tgChatID int64) (chan string, error)
 		if len(gs) != 3 {
 			return nil, fmt.Errorf("invalid command: %s", message)
 		}
-		plugin := strings.ToLower(gs[1])
+		name := strings.ToLower(gs[1])
 		query := strings.TrimSpace(gs[2])
 
 		// directly interact with a plugin
-		var ans string
-		var err error
-		if plugin == "py" || plugin == "python" {
-			ans, err = c.Python.Send(query)
-		} else if plugin == "sh" {
-			args := strings.Split(query, " ")
-			p := subproc.Init(args[0], args[1:]...)
-			out, err := p.Out.ReadString('\x03')
-			if err != nil {
-				log.Println(err)
-			}
-			return c.SendSingleMessage(out), nil
-		} else if plugin == "bing" {
-			ans, err = c.Bing.Send(query)
-		} else if plugin == "wolf" {
-			ans, err = c.Wolfram.Send(query)
-		} else if plugin == "web" {
-			client := c.InitClient(query)
-			err = client.Connect("GET", map[string]string{}, nil)
-			if err != nil {
-				return nil, err
-			}
-			return client.ExtractHtml(MESSAGE_MAX_LENGTH), nil
-		} else {
-			return nil, fmt.Errorf("unknown plugin: %s", plugin)
+		p, ok := c.Plugins.Get(name)
+		if !ok || !plugin.Allowed(p, ctx, false) {
+			return nil, fmt.Errorf("unknown plugin: %s", name)
 		}
-		if err != nil {
+		res, err := p.Run(ctx, query)
+		if errors.Is(err, plugin.ErrNoResult) {
+			return c.SendSingleMessage(QUERY_FAILED), nil
+		} else if ctx.Err() != nil {
+			return c.SendSingleMessage(STOPPED), nil
+		} else if err != nil {
 			log.Println(err)
 			return nil, err
 		}
-		return c.SendSingleMessage(ans), nil
+		return c.SendResult(res), nil
 	} else {
 		role = "user"
 	}
 
-	c.AddMessage(tgChatID, message, role, 0)
+	if len(images) > 0 {
+		model := c.GetConversation(tgChatID).Settings.Model
+		if role != "user" {
+			return nil, errors.New("images can only be sent in user messages")
+		} else if err := CheckVision(model); err != nil {
+			return nil, err
+		}
+	}
+	c.AppendMessage(tgChatID, Message{Role: role, Content: message, Images: images}, 0)
 
 	if role != "user" {
 		return nil, nil
 	}
+	return c.Respond(ctx, tgChatID)
+}
+
+// Respond returns a feed of the answer to the last message of a
+// conversation. Cancelling ctx stops the answer, keeping the part of it
+// received so far in the conversation.
+func (c *GPT4) Respond(ctx context.Context, tgChatID int64) (chan sse.Chunk, error) {
+	ctx = plugin.WithChatID(ctx, tgChatID)
+
+	if _, err := c.Summarize(ctx, tgChatID); err != nil && ctx.Err() == nil {
+		log.Printf("Couldn't summarize conversation: %v", err)
+	}
 
 	// send HTTP POST request
 	client := c.InitClient(OPENAI_API_URL)
-	err = c.SendRequestAvoidTokensExceeded(client, tgChatID, 2)
-	if err != nil {
+	err := c.SendRequest(ctx, client, tgChatID)
+	if ctx.Err() != nil {
+		return c.SendSingleMessage(STOPPED), nil
+	} else if err != nil {
 		return nil, err
 	}
 
-	var plugin string
-	var query string
-	var ans string
-
-	query_pat := regexp.MustCompile(`🤖\s*I ask (\w+)\s+([\s\S]*)`)
-
 	// feed messages to the Telegram user
-	feed := client.FeedForward(
-		func(data []byte, feed chan string) (bool, error) {
-			var res MessageResponse
-			if err = json.Unmarshal(data, &res); err != nil {
-				log.Printf("Couldn't unmarshal message response: %v", err)
-				feed <- "❌ Failed to decode response from GPT4"
-				return true, err
+	feed := make(chan sse.Chunk)
+	go func() {
+		defer close(feed)
+		for {
+			done, err := c.HandleResponse(ctx, client, tgChatID, feed)
+			if err == nil && !done {
+				client = c.InitClient(OPENAI_API_URL)
+				err = c.SendRequest(ctx, client, tgChatID)
+			}
+			if ctx.Err() != nil {
+				log.Printf("Stopped the response in chat %d", tgChatID)
+				feed <- sse.Chunk{Text: STOPPED}
+				return
+			} else if err != nil {
+				feed <- sse.Chunk{Text: fmt.Sprintf("❌ %v", err)}
+				log.Println(err)
+				return
+			} else if done {
+				return
 			}
+		}
+	}()
+	return feed, nil
+}
 
-			if len(res.Choices) > 0 {
-				log.Printf("Got response from GPT4:\n%v\n", res)
+// Imagine generates images as asked by the user with /image and returns a
+// feed of them. The request and the prompt of the images are added to the
+// conversation, so that the images can be changed in the next messages.
+func (c *GPT4) Imagine(ctx context.Context, query string, tgChatID int64) (chan sse.Chunk, error) {
+	ctx = plugin.WithChatID(ctx, tgChatID)
+	res, err := c.QueryPlugin(ctx, "Image", query)
+	if ctx.Err() != nil {
+		return c.SendSingleMessage(STOPPED), nil
+	} else if err != nil {
+		return nil, err
+	}
+	c.AddMessage(tgChatID, "Generate an image: "+query, "user", 0)
+	c.AddMessage(tgChatID, res.Text, "assistant", 0)
+	if res.Summary != "" {
+		res.Text = res.Summary
+	}
+	return c.SendResult(res), nil
+}
 
-				msg := res.Choices[0].Message
-				text := msg.Content
-				text = strings.ReplaceAll(text, "\r\n", "\n")
+// lastUserMessage returns the index of the last user message, or -1.
+func lastUserMessage(messages []Message) int {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return i
+		}
+	}
+	return -1
+}
 
-				// calculate tokens
-				tok_in, tok_out := res.Usage.PromptTokens, res.Usage.CompletionTokens
-				total_tokens := tok_in + tok_out
+// Regenerate replaces the answer to the last user message of a
+// conversation with a new one, whose feed is returned.
+func (c *GPT4) Regenerate(ctx context.Context, tgChatID int64) (chan sse.Chunk, error) {
+	found := false
+	c.UpdateConversation(tgChatID, func(convo *Conversation) {
+		if i := lastUserMessage(convo.Messages); i >= 0 {
+			convo.Messages = convo.Messages[:i+1]
+			found = true
+		}
+	})
+	if !found {
+		return nil, errors.New("no message to answer")
+	}
+	return c.Respond(ctx, tgChatID)
+}
 
-				// update chat history
-				convo := c.AddMessage(tgChatID, text, "assistant", total_tokens)
-				log.Println(convo.GetConversationInfo())
+// Continue asks the model to continue its last answer, which may have been
+// truncated or stopped, and returns a feed of the continuation.
+func (c *GPT4) Continue(ctx context.Context, tgChatID int64) (chan sse.Chunk, error) {
+	c.AddMessage(tgChatID, CONTINUE_PROMPT, "user", 0)
+	return c.Respond(ctx, tgChatID)
+}
 
-				feed <- text
-				if convo.Verbose {
-					feed <- fmt.Sprintf("ℹ️ Tokens: %d => %d", tok_in, tok_out)
-				}
+// DeleteExchange removes the last user message of a conversation and the
+// answer to it. It returns false if there is none.
+func (c *GPT4) DeleteExchange(tgChatID int64) bool {
+	found := false
+	c.UpdateConversation(tgChatID, func(convo *Conversation) {
+		if i := lastUserMessage(convo.Messages); i >= 0 {
+			convo.Messages = convo.Messages[:i]
+			found = true
+		}
+	})
+	return found
+}
+
+// HandleResponse streams a response of GPT4 to feed and runs the plugin
+// queries it contains, if any. It returns true if the response is final.
+func (c *GPT4) HandleResponse(ctx context.Context, client sse.Client, tgChatID int64, feed chan sse.Chunk) (bool, error) {
+	msg, usage, err := c.ReadStream(ctx, client, feed)
+	if ctx.Err() != nil && len(msg.Content) > 0 {
+		// keep the partial answer, without its incomplete tool calls
+		c.AddMessage(tgChatID, msg.Content, "assistant", 0)
+	}
+	if err != nil {
+		return true, err
+	}
+	log.Printf("Got response from GPT4:\n%v\n", msg)
+
+	// calculate tokens
+	tok_in, tok_out := usage.PromptTokens, usage.CompletionTokens
+	total_tokens := tok_in + tok_out
+
+	// update chat history
+	convo := c.AppendMessage(tgChatID, msg, total_tokens)
+	log.Println(convo.GetConversationInfo())
+
+	if convo.Verbose {
+		feed <- sse.Chunk{Text: fmt.Sprintf("ℹ️ Tokens: %d => %d", tok_in, tok_out)}
+	}
+
+	start_time := time.Now()
+
+	if len(msg.ToolCalls) > 0 {
+		c.HandleToolCalls(ctx, msg.ToolCalls, tgChatID, convo.Verbose, feed)
+	} else if match := QUERY_PAT.FindStringSubmatch(msg.Content); len(match) > 0 {
+		err = c.HandleQuery(ctx, match[1], match[2], tgChatID, convo.Verbose, feed)
+	} else {
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+
+	time_elapsed := time.Since(start_time)
+	t := 1*time.Second - time_elapsed
+	if t > 0 {
+		select {
+		case <-time.After(t):
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+	} // minimum 1 second interval between requests
+
+	return false, nil // wait for the next response
+}
+
+// HandleQuery runs a plugin query written in the text of a response and
+// adds the plugin's reply to the conversation.
+func (c *GPT4) HandleQuery(ctx context.Context, name string, query string, tgChatID int64, verbose bool, feed chan sse.Chunk) error {
+	log.Printf("Sending query to %s: %s", name, query)
+
+	res, err := c.QueryPlugin(ctx, name, query)
+	if err != nil {
+		return err
+	}
+	snap := Snapshot(name, res, verbose)
+
+	c.AddMessage(tgChatID, snap, "assistant", 0)
+
+	log.Println(snap)
+	feed <- sse.Chunk{Text: snap}
+	FeedAttachments(res, feed)
+	return nil
+}
+
+// QueryPlugin looks up a plugin by name and sends it a query.
+func (c *GPT4) QueryPlugin(ctx context.Context, name string, query string) (plugin.Result, error) {
+	p, ok := c.Plugins.Get(name)
+	if !ok || !plugin.Allowed(p, ctx, true) {
+		return plugin.Result{}, fmt.Errorf("unknown plugin: %s", name)
+	}
+	res, err := p.Run(ctx, query)
+	if errors.Is(err, plugin.ErrNoResult) {
+		return plugin.Result{Text: QUERY_FAILED}, nil
+	}
+	return res, err
+}
 
-				// match the query pattern
-				match := query_pat.FindStringSubmatch(text)
-
-				if len(match) > 0 {
-					plugin = match[1]
-					query = match[2]
-
-					log.Printf("Sending query to %s: %s", plugin, query)
-
-					start_time := time.Now()
-
-					if plugin == "Bing" {
-						query = strings.Split(query, "\n")[0]
-						ans, err = c.Bing.Send(query)
-					} else if plugin == "Wolfram" {
-						query = strings.Split(query, "\n")[0]
-						ans, err = c.Wolfram.Send(query)
-					} else if plugin == "Python" {
-						pat := regexp.MustCompile("```(py.*)?([\\s\\S]*)\\s*```")
-						match := pat.FindStringSubmatch(query)
-						if len(match) > 0 {
-							query = match[2]
-						}
-						ans, err = c.Python.Send(query)
-					} else if plugin == "Web" {
-						query = strings.Split(query, "\n")[0]
-						client := c.InitClient(strings.TrimSpace(query))
-						err = client.Connect("GET", map[string]string{}, nil)
-						if err != nil {
-							if strings.Contains(err.Error(), "404 Not Found") {
-								ans = "404 Not Found"
-								err = nil
-							} else {
-								ans = ""
-							}
-						} else {
-							ans = <-client.ExtractHtml(6400)
-						}
-					} else {
-						return true, fmt.Errorf("unknown plugin: %s", plugin)
-					}
-
-					if err != nil {
-						return true, err
-					}
-
-					var snap string // snapshot of the answer
-					if !convo.Verbose && len(ans) > 720 {
-						if plugin == "Bing" {
-							ss := regexp.MustCompile(`\[.*?\]\(.*?\)`).FindAllString(ans, -1)
-							snap = strings.Join(ss, "\n")
-						} else {
-							ss := strings.Split(ans, "\n")
-							if len(ss) > 6 {
-								ss = append(append(ss[:3], "..."), ss[len(ss)-3:]...)
-							}
-							for i, s := range ss {
-								if len(s) > 120 {
-									ss[i] = s[:120] + "..."
-								}
-							}
-							snap = strings.Join(ss, "\n")
-						}
-					} else {
-						snap = ans
-					}
-
-					if plugin != "Python" && ans == "" {
-						ans = QUERY_FAILED
-						snap = ans
-					} else {
-						ans = fmt.Sprintf("🤖 %s replies\n\n%s", plugin, ans)
-						snap = fmt.Sprintf("🤖 %s replies\n\n%s", plugin, snap)
-					}
-
-					c.AddMessage(tgChatID, snap, "assistant", 0)
-
-					log.Println(snap)
-					feed <- snap
-
-					time_elapsed := time.Since(start_time)
-					t := 1*time.Second - time_elapsed
-					if t > 0 {
-						time.Sleep(t)
-					} // minimum 1 second interval between requests
-
-					err = c.SendRequestAvoidTokensExceeded(client, tgChatID, 2)
-					if err != nil {
-						return true, err
-					}
-					return false, nil // wait for the next response
+// Snapshot formats the result of a plugin to be shown to the user, shortened
+// unless in verbose mode.
+func Snapshot(name string, res plugin.Result, verbose bool) string {
+	if res.Text == QUERY_FAILED {
+		return res.Text
+	}
+
+	var snap string // snapshot of the answer
+	if !verbose && len(res.Text) > 720 {
+		if res.Summary != "" {
+			snap = res.Summary
+		} else {
+			ss := strings.Split(res.Text, "\n")
+			if len(ss) > 6 {
+				ss = append(append(ss[:3], "..."), ss[len(ss)-3:]...)
+			}
+			for i, s := range ss {
+				if len(s) > 120 {
+					ss[i] = s[:120] + "..."
 				}
-				return true, nil
 			}
-			return true, fmt.Errorf("no response from GPT4")
-		},
-	)
-	return feed, nil
+			snap = strings.Join(ss, "\n")
+		}
+	} else {
+		snap = res.Text
+	}
+	return fmt.Sprintf("🤖 %s replies\n\n%s", name, snap)
 }
 
 func (c *GPT4) Save(chatID int64, filename string) error {
@@ -423,6 +653,8 @@ func (c *GPT4) Save(chatID int64, filename string) error {
 	return ioutil.WriteFile(filename, data, 0644)
 }
 
+// Load replaces a conversation with the one saved in a file, keeping its
+// thread and documents. Its last message is left to the caller to answer.
 func (c *GPT4) Load(chatID int64, filename string) error {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -433,10 +665,13 @@ func (c *GPT4) Load(chatID int64, filename string) error {
 	if err != nil {
 		return err
 	}
-	c.Conversations[chatID] = convo
-	if convo.Messages[len(convo.Messages)-1].Role == "user" {
-		client := c.InitClient(OPENAI_API_URL)
-		return c.SendRequestAvoidTokensExceeded(client, chatID, 2)
+	if convo.Settings.Model == "" { // saved before settings were per chat
+		convo.Settings = c.Defaults
 	}
+	c.UpdateConversation(chatID, func(current *Conversation) {
+		convo.ChatID, convo.Thread = current.ChatID, current.Thread
+		convo.Documents = current.Documents
+		*current = convo
+	})
 	return nil
 }
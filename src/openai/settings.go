@@ -0,0 +1,152 @@
+package openai
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Settings are the sampling parameters of a conversation, sent along with
+// its messages in every request. Zero values of optional parameters, and nil
+// for the parameters whose zero is meaningful, are left to the API defaults.
+type Settings struct {
+	Model            string   `json:"model"`
+	Temperature      float32  `json:"temperature"`
+	TopP             *float32 `json:"top_p,omitempty"`
+	MaxTokens        int      `json:"max_tokens,omitempty"`
+	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+}
+
+const SETTINGS_HELP = `/settings: show the settings of this chat.
+/settings <key> <value>: change a setting ("none" to unset an optional one).
+/settings reset: restore the default settings.
+Keys: model, temperature, top_p, max_tokens, presence_penalty, frequency_penalty, seed, stop (comma-separated).`
+
+func (s Settings) String() string {
+	optional := func(isSet bool, value any) string {
+		if !isSet {
+			return "default"
+		}
+		return fmt.Sprint(value)
+	}
+	topP := "default"
+	if s.TopP != nil {
+		topP = fmt.Sprint(*s.TopP)
+	}
+	seed := "default"
+	if s.Seed != nil {
+		seed = strconv.Itoa(*s.Seed)
+	}
+	return fmt.Sprintf(`model: %s
+temperature: %.2f
+top_p: %s
+max_tokens: %s
+presence_penalty: %s
+frequency_penalty: %s
+seed: %s
+stop: %s`,
+		s.Model, s.Temperature,
+		topP,
+		optional(s.MaxTokens != 0, s.MaxTokens),
+		optional(s.PresencePenalty != 0, s.PresencePenalty),
+		optional(s.FrequencyPenalty != 0, s.FrequencyPenalty),
+		seed,
+		optional(len(s.Stop) > 0, strings.Join(s.Stop, ", ")))
+}
+
+// Set parses and validates the value of a setting.
+func (s *Settings) Set(key string, value string) error {
+	value = strings.TrimSpace(value)
+	unset := strings.EqualFold(value, "none")
+
+	parseFloat := func(min float64, max float64) (float32, error) {
+		if unset {
+			return 0, nil
+		}
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil || f < min || f > max {
+			return 0, fmt.Errorf("%s must be a number in the range [%.1f, %.1f]", key, min, max)
+		}
+		return float32(f), nil
+	}
+
+	switch strings.ToLower(key) {
+	case "model":
+		if unset || value == "" {
+			return fmt.Errorf("model must not be empty")
+		}
+		s.Model = value
+	case "temperature", "temper":
+		if unset {
+			return fmt.Errorf("temperature must not be empty")
+		}
+		f, err := parseFloat(0, 2)
+		if err != nil {
+			return err
+		}
+		s.Temperature = f
+	case "top_p":
+		if unset {
+			s.TopP = nil
+			return nil
+		}
+		f, err := parseFloat(0, 1)
+		if err != nil {
+			return err
+		}
+		s.TopP = &f
+	case "presence_penalty":
+		f, err := parseFloat(-2, 2)
+		if err != nil {
+			return err
+		}
+		s.PresencePenalty = f
+	case "frequency_penalty":
+		f, err := parseFloat(-2, 2)
+		if err != nil {
+			return err
+		}
+		s.FrequencyPenalty = f
+	case "max_tokens":
+		if unset {
+			s.MaxTokens = 0
+			return nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("max_tokens must be a positive integer")
+		}
+		s.MaxTokens = n
+	case "seed":
+		if unset {
+			s.Seed = nil
+			return nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("seed must be an integer")
+		}
+		s.Seed = &n
+	case "stop":
+		if unset {
+			s.Stop = nil
+			return nil
+		}
+		var stop []string
+		for _, seq := range strings.Split(value, ",") {
+			if seq = strings.TrimSpace(seq); seq != "" {
+				stop = append(stop, seq)
+			}
+		}
+		if len(stop) > 4 {
+			return fmt.Errorf("at most 4 stop sequences are allowed")
+		}
+		s.Stop = stop
+	default:
+		return fmt.Errorf("unknown setting: %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package openai
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSettingsTopP(t *testing.T) {
+	s := Settings{Model: "gpt-4o", Temperature: 1}
+	data, _ := json.Marshal(s)
+	if strings.Contains(string(data), "top_p") {
+		t.Errorf("unset top_p sent: %s", data)
+	}
+
+	if err := s.Set("top_p", "0"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = json.Marshal(s)
+	if !strings.Contains(string(data), `"top_p":0`) {
+		t.Errorf("top_p 0 not sent: %s", data)
+	}
+	if !strings.Contains(s.String(), "top_p: 0\n") {
+		t.Errorf("top_p 0 shown as\n%s", s)
+	}
+
+	if err := s.Set("top_p", "1.5"); err == nil {
+		t.Error("top_p out of range accepted")
+	}
+	if err := s.Set("top_p", "none"); err != nil || s.TopP != nil {
+		t.Errorf("top_p not unset: %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package openai
+
+import (
+	"log"
+	"sync"
+)
+
+// THREAD_BASE is the largest key of a thread conversation. Telegram chat IDs
+// fit in 52 bits, so they don't collide with the keys of threads.
+const THREAD_BASE = -1 << 52
+
+// Storage persists the conversations of a store as they change.
+type Storage interface {
+	Save(chatID int64, convo Conversation) error
+	Delete(chatID int64) error
+	LoadAll() (map[int64]Conversation, error)
+	Close() error
+}
+
+// ConversationStore is a concurrency-safe map of conversations by chat ID.
+// Conversations are returned as copies, so they can be read while being
+// updated by other goroutines.
+type ConversationStore struct {
+	mu      sync.RWMutex
+	convos  map[int64]Conversation
+	threads map[threadMessage]int64 // key of the thread of each message in a thread
+	next    int64                   // key of the next thread
+	init    func() Conversation
+	storage Storage
+	saves   map[int64]*saveState
+	pending sync.WaitGroup // saves in progress
+}
+
+// saveState orders the saves of a conversation, which are done outside the
+// lock of the store.
+type saveState struct {
+	mu      sync.Mutex
+	version uint64 // of the last change
+	saved   uint64 // version of the last change saved
+}
+
+// threadMessage is a Telegram message of a group chat.
+type threadMessage struct {
+	chatID    int64
+	messageID int
+}
+
+// NewConversationStore creates a store in which missing conversations are
+// created by init when updated.
+func NewConversationStore(init func() Conversation) *ConversationStore {
+	return &ConversationStore{
+		convos:  make(map[int64]Conversation),
+		threads: make(map[threadMessage]int64),
+		next:    THREAD_BASE,
+		init:    init,
+		saves:   make(map[int64]*saveState),
+	}
+}
+
+// Persist restores the conversations saved in storage and saves every
+// subsequent change to it.
+func (s *ConversationStore) Persist(storage Storage) error {
+	convos, err := storage.LoadAll()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for chatID, convo := range convos {
+		if convo.Settings.Model == "" { // saved before settings were per chat
+			convo.Settings = s.init().Settings
+		}
+		s.index(chatID, s.convos[chatID], convo)
+		s.convos[chatID] = convo
+	}
+	s.storage = storage
+	return nil
+}
+
+// Close closes the storage of the store, if any, once the saves in progress
+// are done.
+func (s *ConversationStore) Close() error {
+	s.mu.Lock()
+	storage := s.storage
+	s.storage = nil
+	s.mu.Unlock()
+	if storage == nil {
+		return nil
+	}
+	s.pending.Wait()
+	return storage.Close()
+}
+
+func (s *ConversationStore) Get(chatID int64) (Conversation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	convo, ok := s.convos[chatID]
+	return convo.copy(), ok
+}
+
+func (s *ConversationStore) Set(chatID int64, convo Conversation) {
+	s.mu.Lock()
+	s.index(chatID, s.convos[chatID], convo)
+	s.convos[chatID] = convo.copy()
+	save := s.save(chatID, &convo)
+	s.mu.Unlock()
+	save()
+}
+
+func (s *ConversationStore) Delete(chatID int64) {
+	s.mu.Lock()
+	s.index(chatID, s.convos[chatID], Conversation{})
+	delete(s.convos, chatID)
+	save := s.save(chatID, nil)
+	s.mu.Unlock()
+	save()
+}
+
+// Update atomically modifies a conversation, creating it if missing, and
+// returns a copy of the result.
+func (s *ConversationStore) Update(chatID int64, update func(convo *Conversation)) Conversation {
+	s.mu.Lock()
+	convo, ok := s.convos[chatID]
+	if !ok {
+		convo = s.init()
+	}
+	old := Conversation{ChatID: convo.ChatID, Thread: convo.Thread}
+	update(&convo)
+	s.index(chatID, old, convo)
+	s.convos[chatID] = convo
+	save := s.save(chatID, &convo)
+	s.mu.Unlock()
+	save()
+	return convo.copy()
+}
+
+// FindThread returns the key of the conversation of the thread of a group
+// chat containing a message, if any.
+func (s *ConversationStore) FindThread(chatID int64, messageID int) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.threads[threadMessage{chatID, messageID}]
+	return key, ok
+}
+
+// Thread returns the key of the conversation of the thread of a group chat
+// containing a message, creating a thread rooted at the message if there is
+// none.
+func (s *ConversationStore) Thread(chatID int64, messageID int) int64 {
+	s.mu.Lock()
+	if key, ok := s.threads[threadMessage{chatID, messageID}]; ok {
+		s.mu.Unlock()
+		return key
+	}
+	key := s.next
+	convo := s.init()
+	convo.ChatID = chatID
+	convo.Thread = []int{messageID}
+	s.convos[key] = convo
+	s.index(key, Conversation{}, convo)
+	save := s.save(key, &convo)
+	s.mu.Unlock()
+	save()
+	return key
+}
+
+// index updates the index of the messages of the threads after the thread
+// of a conversation changed from old to convo. Threads only grow, so only
+// their new messages are indexed. The caller must hold the lock.
+func (s *ConversationStore) index(key int64, old Conversation, convo Conversation) {
+	if key <= s.next {
+		s.next = key - 1
+	}
+	if old.ChatID == convo.ChatID && len(old.Thread) <= len(convo.Thread) {
+		for _, id := range convo.Thread[len(old.Thread):] {
+			s.threads[threadMessage{convo.ChatID, id}] = key
+		}
+		return
+	}
+	for _, id := range old.Thread {
+		if s.threads[threadMessage{old.ChatID, id}] == key {
+			delete(s.threads, threadMessage{old.ChatID, id})
+		}
+	}
+	for _, id := range convo.Thread {
+		s.threads[threadMessage{convo.ChatID, id}] = key
+	}
+}
+
+func (s *ConversationStore) ChatIDs() []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]int64, 0, len(s.convos))
+	for k := range s.convos {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// save takes a snapshot of a changed conversation, or nil if it was
+// deleted, and returns a function persisting it, to be called once the lock
+// is released so that the database writes don't block the other chats. The
+// caller must hold the lock, which orders the changes of a chat: a save
+// overtaken by a later one is skipped.
+func (s *ConversationStore) save(chatID int64, convo *Conversation) func() {
+	storage := s.storage
+	if storage == nil {
+		return func() {}
+	}
+	state, ok := s.saves[chatID]
+	if !ok {
+		state = &saveState{}
+		s.saves[chatID] = state
+	}
+	state.version++
+	version := state.version
+	var snapshot Conversation
+	if convo != nil {
+		snapshot = convo.copy()
+	}
+	s.pending.Add(1)
+	return func() {
+		defer s.pending.Done()
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		if version <= state.saved {
+			return
+		}
+		state.saved = version
+		if convo == nil {
+			if err := storage.Delete(chatID); err != nil {
+				log.Printf("Couldn't delete conversation %d: %v", chatID, err)
+			}
+		} else if err := storage.Save(chatID, snapshot); err != nil {
+			log.Printf("Couldn't save conversation %d: %v", chatID, err)
+		}
+	}
+}
+
+func (t Conversation) copy() Conversation {
+	t.Messages = append([]Message(nil), t.Messages...)
+	t.Archive = append([]Message(nil), t.Archive...)
+	t.Thread = append([]int(nil), t.Thread...)
+	t.Documents = append([]Document(nil), t.Documents...)
+	return t
+}
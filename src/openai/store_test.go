@@ -0,0 +1,267 @@
+package openai
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newTestStore() *ConversationStore {
+	return NewConversationStore(func() Conversation {
+		return Conversation{Settings: Settings{Model: "gpt-4o"}}
+	})
+}
+
+// memoryStorage is a Storage keeping the saved conversations in memory.
+type memoryStorage struct {
+	mu     sync.Mutex
+	convos map[int64]Conversation
+	saves  int
+}
+
+func (m *memoryStorage) Save(chatID int64, convo Conversation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.convos[chatID] = convo.copy()
+	m.saves++
+	return nil
+}
+
+func (m *memoryStorage) Delete(chatID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.convos, chatID)
+	return nil
+}
+
+func (m *memoryStorage) LoadAll() (map[int64]Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	convos := make(map[int64]Conversation)
+	for k, v := range m.convos {
+		convos[k] = v.copy()
+	}
+	return convos, nil
+}
+
+func (m *memoryStorage) Close() error {
+	return nil
+}
+
+func TestStoreConcurrentUpdates(t *testing.T) {
+	s := newTestStore()
+	const chats, writers, messages = 8, 4, 50
+	var wg sync.WaitGroup
+	for chat := int64(1); chat <= chats; chat++ {
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(chat int64, w int) {
+				defer wg.Done()
+				for i := 0; i < messages; i++ {
+					s.Update(chat, func(convo *Conversation) {
+						convo.Messages = append(convo.Messages, Message{
+							Role:    "user",
+							Content: fmt.Sprintf("%d-%d", w, i),
+						})
+						convo.TotalTokens++
+					})
+					// readers run along the writers
+					convo, _ := s.Get(chat)
+					_ = len(convo.Messages)
+					_ = s.ChatIDs()
+				}
+			}(chat, w)
+		}
+	}
+	wg.Wait()
+
+	for chat := int64(1); chat <= chats; chat++ {
+		convo, ok := s.Get(chat)
+		if !ok {
+			t.Fatalf("chat %d is missing", chat)
+		}
+		if len(convo.Messages) != writers*messages || convo.TotalTokens != writers*messages {
+			t.Errorf("chat %d has %d messages and %d tokens, want %d",
+				chat, len(convo.Messages), convo.TotalTokens, writers*messages)
+		}
+		// the messages of each writer stay in order
+		next := make([]int, writers)
+		for _, msg := range convo.Messages {
+			var w, i int
+			fmt.Sscanf(msg.Content, "%d-%d", &w, &i)
+			if i != next[w] {
+				t.Fatalf("chat %d: message %d of writer %d out of order", chat, i, w)
+			}
+			next[w]++
+		}
+	}
+	if n := len(s.ChatIDs()); n != chats {
+		t.Errorf("%d chats, want %d", n, chats)
+	}
+}
+
+func TestStoreReturnsCopies(t *testing.T) {
+	s := newTestStore()
+	s.Update(1, func(convo *Conversation) {
+		convo.Messages = append(convo.Messages, Message{Role: "user", Content: "a"})
+	})
+	convo, _ := s.Get(1)
+	convo.Messages[0].Content = "changed"
+	convo.Messages = append(convo.Messages, Message{Role: "user", Content: "b"})
+
+	convo, _ = s.Get(1)
+	if len(convo.Messages) != 1 || convo.Messages[0].Content != "a" {
+		t.Errorf("a copy changed the store: %+v", convo.Messages)
+	}
+	if _, ok := s.Get(2); ok {
+		t.Error("Get created a conversation")
+	}
+}
+
+func TestStorePersists(t *testing.T) {
+	storage := &memoryStorage{convos: map[int64]Conversation{
+		5: {Messages: []Message{{Role: "user", Content: "saved"}}},
+	}}
+	s := newTestStore()
+	if err := s.Persist(storage); err != nil {
+		t.Fatal(err)
+	}
+	convo, ok := s.Get(5)
+	if !ok || len(convo.Messages) != 1 || convo.Settings.Model != "gpt-4o" {
+		t.Fatalf("restored %+v, %v", convo, ok)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.Update(int64(i%4), func(convo *Conversation) {
+				convo.Messages = append(convo.Messages, Message{Role: "user", Content: "x"})
+			})
+		}(i)
+	}
+	wg.Wait()
+	s.Delete(5)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, _ := storage.LoadAll()
+	if _, ok := saved[5]; ok {
+		t.Error("the deleted conversation is still saved")
+	}
+	for chat := int64(0); chat < 4; chat++ {
+		if n := len(saved[chat].Messages); n != 5 {
+			t.Errorf("chat %d saved with %d messages, want 5", chat, n)
+		}
+	}
+}
+
+func TestStoreThreads(t *testing.T) {
+	s := newTestStore()
+	if _, ok := s.FindThread(-100, 1); ok || len(s.ChatIDs()) != 0 {
+		t.Error("FindThread found or created a thread of an unknown message")
+	}
+	first := s.Thread(-100, 1)
+	if first != THREAD_BASE {
+		t.Errorf("first thread has key %d, want %d", first, int64(THREAD_BASE))
+	}
+	s.Update(first, func(convo *Conversation) {
+		convo.Thread = append(convo.Thread, 2, 3)
+	})
+	for _, id := range []int{1, 2, 3} {
+		if key, ok := s.FindThread(-100, id); !ok || key != first {
+			t.Errorf("message %d found in thread %d, want %d", id, key, first)
+		}
+		if key := s.Thread(-100, id); key != first {
+			t.Errorf("message %d is in thread %d, want %d", id, key, first)
+		}
+	}
+
+	second := s.Thread(-200, 2) // same message ID in another chat
+	if second == first {
+		t.Fatal("the threads of two chats share a key")
+	}
+	if convo, _ := s.Get(second); convo.ChatID != -200 || len(convo.Thread) != 1 {
+		t.Errorf("new thread %+v", convo)
+	}
+
+	s.Delete(first)
+	if key := s.Thread(-100, 2); key == first || key == second {
+		t.Errorf("message of a deleted thread found in thread %d", key)
+	}
+
+	// the index is rebuilt from the storage
+	storage := &memoryStorage{convos: map[int64]Conversation{
+		THREAD_BASE - 5: {ChatID: -100, Thread: []int{7, 8}},
+	}}
+	s = newTestStore()
+	if err := s.Persist(storage); err != nil {
+		t.Fatal(err)
+	}
+	if key := s.Thread(-100, 8); key != THREAD_BASE-5 {
+		t.Errorf("restored message is in thread %d", key)
+	}
+	if key := s.Thread(-100, 9); key != THREAD_BASE-6 {
+		t.Errorf("new thread has key %d, want %d", key, int64(THREAD_BASE-6))
+	}
+}
+
+// blockingStorage is a memoryStorage whose save of the first change of
+// chat 1 waits for release.
+type blockingStorage struct {
+	memoryStorage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStorage) Save(chatID int64, convo Conversation) error {
+	if chatID == 1 && convo.Summary == "first" {
+		b.started <- struct{}{}
+		<-b.release
+	}
+	return b.memoryStorage.Save(chatID, convo)
+}
+
+func TestStoreSavesOutsideLock(t *testing.T) {
+	storage := &blockingStorage{
+		memoryStorage: memoryStorage{convos: make(map[int64]Conversation)},
+		started:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	s := newTestStore()
+	if err := s.Persist(storage); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Update(1, func(convo *Conversation) { convo.Summary = "first" })
+	}()
+	<-storage.started
+
+	// the other chats are neither blocked nor waiting for the save of chat 1
+	s.Update(2, func(convo *Conversation) { convo.Summary = "other" })
+	if convo, _ := s.Get(1); convo.Summary != "first" {
+		t.Errorf("chat 1 has summary %q while being saved", convo.Summary)
+	}
+	// a later change of chat 1 is saved after the first one
+	second := make(chan struct{})
+	go func() {
+		defer close(second)
+		s.Update(1, func(convo *Conversation) { convo.Summary = "second" })
+	}()
+	close(storage.release)
+	<-done
+	<-second
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, _ := storage.LoadAll()
+	if saved[1].Summary != "second" || saved[2].Summary != "other" {
+		t.Errorf("saved %q and %q", saved[1].Summary, saved[2].Summary)
+	}
+}
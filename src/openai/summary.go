@@ -0,0 +1,135 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tztsai/openai-telegram/src/tokenizer"
+)
+
+// KEEP_MESSAGES is the number of latest messages never summarized.
+const KEEP_MESSAGES = 6
+
+const SUMMARY_PROMPT = `You summarize a conversation between a user and an AI assistant, so that the assistant can continue it without the original messages. Write a concise summary of the facts, decisions, results of plugins, open questions and preferences of the user. Keep names, numbers, URLs and code identifiers exact. Reply with the summary only.`
+
+const SUMMARY_HEADER = "Summary of the earlier conversation:\n\n"
+
+// WithSummary inserts the summary of a conversation after its leading system
+// messages.
+func WithSummary(messages []Message, summary string) []Message {
+	if summary == "" {
+		return messages
+	}
+	i := 0
+	for i < len(messages) && messages[i].Role == "system" {
+		i++
+	}
+	result := make([]Message, 0, len(messages)+1)
+	result = append(result, messages[:i]...)
+	result = append(result, Message{Role: "system", Content: SUMMARY_HEADER + summary})
+	return append(result, messages[i:]...)
+}
+
+// Summarize condenses the earlier messages of a conversation into its summary
+// once the conversation exceeds SummaryThreshold tokens. The summarized
+// messages are moved to the archive of the conversation. It returns the
+// number of summarized messages.
+func (c *GPT4) Summarize(ctx context.Context, chatID int64) (int, error) {
+	if c.SummaryThreshold <= 0 {
+		return 0, nil
+	}
+	convo := c.GetConversation(chatID)
+
+	enc, err := tokenizer.Get(GetModelInfo(convo.Settings.Model).Encoding)
+	if err != nil {
+		return 0, err
+	}
+	if CountTokens(enc, WithSummary(convo.Messages, convo.Summary), nil) <= c.SummaryThreshold {
+		return 0, nil
+	}
+
+	// summarize the messages before the latest ones, without separating
+	// tool calls from their results
+	cut := len(convo.Messages) - KEEP_MESSAGES
+	for cut > 0 && convo.Messages[cut].Role == "tool" {
+		cut--
+	}
+	var older []Message
+	for _, msg := range convo.Messages[:cut] {
+		if msg.Role != "system" {
+			older = append(older, msg)
+		}
+	}
+	if len(older) < 2 {
+		return 0, nil
+	}
+
+	var prompt strings.Builder
+	if convo.Summary != "" {
+		prompt.WriteString("Previous summary:\n\n" + convo.Summary + "\n\n")
+	}
+	prompt.WriteString("Messages:\n\n")
+	for _, msg := range older {
+		prompt.WriteString(FormatMessage(msg) + "\n\n")
+	}
+
+	summary, _, err := c.Complete(ctx, Settings{Model: convo.Settings.Model, Temperature: 0.2}, []Message{
+		{Role: "system", Content: SUMMARY_PROMPT},
+		{Role: "user", Content: prompt.String()},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	c.UpdateConversation(chatID, func(convo *Conversation) {
+		var kept []Message
+		for i, msg := range convo.Messages {
+			if i < cut && msg.Role != "system" {
+				convo.Archive = append(convo.Archive, msg)
+			} else {
+				kept = append(kept, msg)
+			}
+		}
+		convo.Messages = kept
+		convo.Summary = strings.TrimSpace(summary)
+	})
+	log.Printf("Summarized %d messages of chat %d", len(older), chatID)
+	return len(older), nil
+}
+
+// FormatMessage formats a message as a line of a transcript.
+func FormatMessage(msg Message) string {
+	text := fmt.Sprintf("[%s] %s", msg.Role, msg.Content)
+	if len(msg.Images) > 0 {
+		text += fmt.Sprintf("\n(attaches %d images)", len(msg.Images))
+	}
+	for _, call := range msg.ToolCalls {
+		text += fmt.Sprintf("\n(calls %s with %s)", call.Function.Name, call.Function.Arguments)
+	}
+	return text
+}
+
+// Complete sends a non-streamed request and returns the content of the reply.
+func (c *GPT4) Complete(ctx context.Context, settings Settings, messages []Message) (string, Usage, error) {
+	client := c.InitClient(OPENAI_API_URL)
+	req := Request{Settings: settings, Messages: messages}
+	if err := client.Connect(ctx, "POST", map[string]string{}, req); err != nil {
+		return "", Usage{}, err
+	}
+
+	event, ok := <-client.EventChannel
+	if !ok || len(event.Data) == 0 {
+		return "", Usage{}, fmt.Errorf("no response from GPT4")
+	}
+	var res MessageResponse
+	if err := json.Unmarshal([]byte(event.Data), &res); err != nil {
+		return "", Usage{}, fmt.Errorf("failed to decode response from GPT4: %v", err)
+	}
+	if len(res.Choices) == 0 {
+		return "", res.Usage, fmt.Errorf("no response from GPT4")
+	}
+	return res.Choices[0].Message.Content, res.Usage, nil
+}
@@ -0,0 +1,157 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/tztsai/openai-telegram/src/plugin"
+	"github.com/tztsai/openai-telegram/src/sse"
+)
+
+type Tool struct {
+	Type     string      `json:"type"`
+	Function FunctionDef `json:"function"`
+}
+
+type FunctionDef struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters"`
+}
+
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolCallDelta is a fragment of a tool call in a streamed response.
+type ToolCallDelta struct {
+	Index    int          `json:"index"`
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+// CANCELLED is the reply of the tool calls stopped by the user.
+const CANCELLED = "Cancelled by the user."
+
+// QueryArgs are the arguments of every plugin function.
+type QueryArgs struct {
+	Query json.RawMessage `json:"query"`
+}
+
+// Text returns the query as passed to the plugin: a string query as is, and
+// a query of another type, such as an object of options, as JSON.
+func (a QueryArgs) Text() string {
+	var text string
+	if err := json.Unmarshal(a.Query, &text); err == nil {
+		return text
+	}
+	return string(a.Query)
+}
+
+// Tools returns a function tool for each plugin the model may use in a
+// query with ctx.
+func (c *GPT4) Tools(ctx context.Context) []Tool {
+	var tools []Tool
+	for _, p := range c.Plugins.List() {
+		if !plugin.Allowed(p, ctx, true) {
+			continue
+		}
+		tools = append(tools, Tool{
+			Type: "function",
+			Function: FunctionDef{
+				Name:        p.Name(),
+				Description: p.Description(),
+				Parameters: map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"query": p.InputSchema(),
+					},
+					"required": []string{"query"},
+				},
+			},
+		})
+	}
+	return tools
+}
+
+// MergeInto adds the fragment to the tool call at its index.
+func (d ToolCallDelta) MergeInto(calls []ToolCall) []ToolCall {
+	for len(calls) <= d.Index {
+		calls = append(calls, ToolCall{Type: "function"})
+	}
+	call := &calls[d.Index]
+	if d.ID != "" {
+		call.ID = d.ID
+	}
+	if d.Type != "" {
+		call.Type = d.Type
+	}
+	call.Function.Name += d.Function.Name
+	call.Function.Arguments += d.Function.Arguments
+	return calls
+}
+
+// HandleToolCalls runs the plugins called by a response and adds their
+// replies to the conversation as tool messages. Once ctx is cancelled, the
+// remaining calls get a cancellation notice as their reply, since every call
+// must be answered.
+func (c *GPT4) HandleToolCalls(ctx context.Context, calls []ToolCall, tgChatID int64, verbose bool, feed chan sse.Chunk) {
+	for _, call := range calls {
+		name := call.Function.Name
+
+		var args QueryArgs
+		var res plugin.Result
+		if ctx.Err() != nil {
+			res.Text = CANCELLED
+		} else if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+			res.Text = fmt.Sprintf("Invalid arguments: %v", err)
+		} else {
+			query := args.Text()
+			log.Printf("Sending query to %s: %s", name, query)
+			feed <- sse.Chunk{Text: fmt.Sprintf("🤖 I ask %s\n%s", name, query)}
+
+			if res, err = c.QueryPlugin(ctx, name, query); ctx.Err() != nil {
+				res.Text = CANCELLED
+			} else if err != nil {
+				log.Println(err)
+				res.Text = fmt.Sprintf("Error: %v", err)
+			}
+		}
+
+		if res.Text != CANCELLED {
+			snap := Snapshot(name, res, verbose)
+			log.Println(snap)
+			feed <- sse.Chunk{Text: snap}
+			FeedAttachments(res, feed)
+		}
+
+		c.AppendMessage(tgChatID, Message{
+			Role:       "tool",
+			Content:    res.Text,
+			ToolCallID: call.ID,
+		}, 0)
+	}
+}
+
+// FeedAttachments feeds the images and files of a plugin result to the user,
+// several images being sent as an album.
+func FeedAttachments(res plugin.Result, feed chan sse.Chunk) {
+	if len(res.Images) > 1 {
+		feed <- sse.Chunk{Album: res.Images}
+	} else if len(res.Images) == 1 {
+		feed <- sse.Chunk{Photo: res.Images[0]}
+	}
+	for _, file := range res.Files {
+		feed <- sse.Chunk{Document: file}
+	}
+}
@@ -0,0 +1,138 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoResult is returned by a plugin that found nothing for a query.
+var ErrNoResult = errors.New("no result")
+
+type Result struct {
+	Text    string
+	Summary string   // shorter text shown to the user instead of a long Text
+	Images  []string // paths of images to show to the user
+	Files   []string // paths of files to send to the user
+}
+
+type Plugin interface {
+	Name() string
+	Aliases() []string
+	Description() string
+	// InputSchema is the JSON schema of the query passed to Run.
+	InputSchema() map[string]any
+	Run(ctx context.Context, query string) (Result, error)
+}
+
+// Guard is implemented by the plugins restricting who may use them.
+type Guard interface {
+	// Allow reports whether a query with ctx may use the plugin. byModel is
+	// true for the queries of the model, false for those of the user.
+	Allow(ctx context.Context, byModel bool) bool
+}
+
+// Allowed reports whether a query with ctx may use a plugin.
+func Allowed(p Plugin, ctx context.Context, byModel bool) bool {
+	if g, ok := p.(Guard); ok {
+		return g.Allow(ctx, byModel)
+	}
+	return true
+}
+
+// Registry looks up plugins by their names or aliases, case-insensitively.
+type Registry struct {
+	plugins []Plugin
+	index   map[string]Plugin
+}
+
+func NewRegistry(plugins ...Plugin) *Registry {
+	r := &Registry{index: make(map[string]Plugin)}
+	for _, p := range plugins {
+		r.Register(p)
+	}
+	return r
+}
+
+func (r *Registry) Register(p Plugin) {
+	r.plugins = append(r.plugins, p)
+	r.index[strings.ToLower(p.Name())] = p
+	for _, alias := range p.Aliases() {
+		r.index[strings.ToLower(alias)] = p
+	}
+}
+
+func (r *Registry) Get(name string) (Plugin, bool) {
+	p, ok := r.index[strings.ToLower(name)]
+	return p, ok
+}
+
+func (r *Registry) List() []Plugin {
+	return r.plugins
+}
+
+// Public returns the plugins available to everyone, i.e. without a Guard.
+func (r *Registry) Public() []Plugin {
+	var plugins []Plugin
+	for _, p := range r.plugins {
+		if _, ok := p.(Guard); !ok {
+			plugins = append(plugins, p)
+		}
+	}
+	return plugins
+}
+
+// Names returns the names of the public plugins.
+func (r *Registry) Names() []string {
+	var names []string
+	for _, p := range r.Public() {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// Describe returns a numbered list of the public plugins and their
+// descriptions.
+func (r *Registry) Describe() string {
+	var lines []string
+	for i, p := range r.Public() {
+		lines = append(lines, fmt.Sprintf("%d. %s: %s", i+1, p.Name(), p.Description()))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type chatIDKey struct{}
+
+// WithChatID returns a context telling plugins the chat a query comes from,
+// for the plugins keeping a state per chat.
+func WithChatID(ctx context.Context, chatID int64) context.Context {
+	return context.WithValue(ctx, chatIDKey{}, chatID)
+}
+
+// ChatID returns the chat a query comes from, 0 if unknown.
+func ChatID(ctx context.Context) int64 {
+	chatID, _ := ctx.Value(chatIDKey{}).(int64)
+	return chatID
+}
+
+type adminKey struct{}
+
+// WithAdmin returns a context telling plugins whether a query comes from an
+// admin of the bot.
+func WithAdmin(ctx context.Context, admin bool) context.Context {
+	return context.WithValue(ctx, adminKey{}, admin)
+}
+
+func IsAdmin(ctx context.Context) bool {
+	admin, _ := ctx.Value(adminKey{}).(bool)
+	return admin
+}
+
+// StringSchema is the input schema of a plugin taking a plain string query.
+func StringSchema(description string) map[string]any {
+	return map[string]any{
+		"type":        "string",
+		"description": description,
+	}
+}
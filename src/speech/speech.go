@@ -0,0 +1,31 @@
+package speech
+
+import (
+	"context"
+
+	"github.com/tztsai/openai-telegram/src/config"
+)
+
+// Transcriber converts the speech of an audio file to text.
+type Transcriber interface {
+	Transcribe(ctx context.Context, path string) (string, error)
+}
+
+// InitTranscriber returns the speech-to-text backend selected by STT_BACKEND:
+// the Whisper API of OpenAI by default, or a local whisper.cpp.
+func InitTranscriber(config *config.EnvConfig) Transcriber {
+	if config.STTBackend == "whispercpp" {
+		return &WhisperCpp{
+			Path:     config.WhisperCppPath,
+			Model:    config.WhisperCppModel,
+			FFmpeg:   config.FFmpegPath,
+			Language: config.STTLanguage,
+		}
+	}
+	return &Whisper{
+		URL:      TRANSCRIPTION_URL,
+		Key:      config.OpenAIKey,
+		Model:    config.STTModel,
+		Language: config.STTLanguage,
+	}
+}
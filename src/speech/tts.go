@@ -0,0 +1,155 @@
+package speech
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tztsai/openai-telegram/src/config"
+)
+
+const SPEECH_URL = "https://api.openai.com/v1/audio/speech"
+
+// MAX_INPUT is the max length of the text synthesized by the speech API.
+const MAX_INPUT = 4096
+
+// Synthesizer converts text to speech, written to a temporary OGG/Opus file
+// whose path is returned.
+type Synthesizer interface {
+	Synthesize(ctx context.Context, text string) (string, error)
+}
+
+// InitSynthesizer returns the text-to-speech backend selected by
+// TTS_BACKEND: the speech API of OpenAI by default, piper or espeak.
+func InitSynthesizer(config *config.EnvConfig) Synthesizer {
+	switch config.TTSBackend {
+	case "piper":
+		return &Piper{Path: config.TTSPath, Model: config.TTSModel, FFmpeg: config.FFmpegPath}
+	case "espeak":
+		return &Espeak{Path: config.TTSPath, Voice: config.TTSVoice, FFmpeg: config.FFmpegPath}
+	}
+	return &Speech{URL: SPEECH_URL, Key: config.OpenAIKey, Model: config.TTSModel, Voice: config.TTSVoice}
+}
+
+// Speech synthesizes speech with the speech API of OpenAI.
+type Speech struct {
+	URL   string
+	Key   string
+	Model string
+	Voice string
+}
+
+func (s *Speech) Synthesize(ctx context.Context, text string) (string, error) {
+	if utf8.RuneCountInString(text) > MAX_INPUT {
+		text = string([]rune(text)[:MAX_INPUT])
+	}
+	data, err := json.Marshal(map[string]string{
+		"model":           s.Model,
+		"input":           text,
+		"voice":           s.Voice,
+		"response_format": "opus",
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.URL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.Key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("speech synthesis failed with status %s: %s", resp.Status, body)
+	}
+
+	file, err := os.CreateTemp("", "speech-*.ogg")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Piper synthesizes speech with a local piper.
+type Piper struct {
+	Path   string // piper executable
+	Model  string // path of an ONNX voice
+	FFmpeg string
+}
+
+func (p *Piper) Synthesize(ctx context.Context, text string) (string, error) {
+	return synthesizeWAV(ctx, p.FFmpeg, func(wav string) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, p.Path, "--model", p.Model, "--output_file", wav)
+		cmd.Stdin = strings.NewReader(text)
+		return cmd
+	})
+}
+
+// Espeak synthesizes speech with a local espeak or espeak-ng.
+type Espeak struct {
+	Path   string // espeak executable
+	Voice  string // language or voice, the default one if empty
+	FFmpeg string
+}
+
+func (e *Espeak) Synthesize(ctx context.Context, text string) (string, error) {
+	return synthesizeWAV(ctx, e.FFmpeg, func(wav string) *exec.Cmd {
+		args := []string{"-w", wav, "--stdin"}
+		if e.Voice != "" {
+			args = append(args, "-v", e.Voice)
+		}
+		cmd := exec.CommandContext(ctx, e.Path, args...)
+		cmd.Stdin = strings.NewReader(text)
+		return cmd
+	})
+}
+
+// synthesizeWAV runs the command returned by synthesize to write a WAV
+// file, then converts it with ffmpeg to OGG/Opus, the format of the voice
+// notes of Telegram.
+func synthesizeWAV(ctx context.Context, ffmpeg string, synthesize func(wav string) *exec.Cmd) (string, error) {
+	dir, err := os.MkdirTemp("", "speech-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	wav := filepath.Join(dir, "speech.wav")
+
+	cmd := synthesize(wav)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("speech synthesis failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	file, err := os.CreateTemp("", "speech-*.ogg")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	out, err := exec.CommandContext(ctx, ffmpeg, "-y", "-loglevel", "error", "-i", wav,
+		"-c:a", "libopus", "-b:a", "32k", file.Name()).CombinedOutput()
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("couldn't convert audio: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return file.Name(), nil
+}
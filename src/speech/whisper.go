@@ -0,0 +1,122 @@
+package speech
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const TRANSCRIPTION_URL = "https://api.openai.com/v1/audio/transcriptions"
+
+// Whisper transcribes speech with the transcription API of OpenAI.
+type Whisper struct {
+	URL      string
+	Key      string
+	Model    string
+	Language string // ISO-639-1 code, detected if empty
+}
+
+func (w *Whisper) Transcribe(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("model", w.Model)
+	form.WriteField("response_format", "json")
+	if w.Language != "" {
+		form.WriteField("language", w.Language)
+	}
+	part, err := form.CreateFormFile("file", uploadName(path))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return "", err
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+w.Key)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("transcription failed with status %s: %s", resp.Status, data)
+	}
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// uploadName returns the name under which an audio file is uploaded. The
+// voice notes of Telegram are OGG files with the .oga extension, which the
+// API rejects.
+func uploadName(path string) string {
+	name := filepath.Base(path)
+	switch ext := filepath.Ext(name); strings.ToLower(ext) {
+	case ".oga", ".opus":
+		return strings.TrimSuffix(name, ext) + ".ogg"
+	}
+	return name
+}
+
+// WhisperCpp transcribes speech with a local whisper.cpp, after converting
+// it with ffmpeg to the 16 kHz WAV format it requires.
+type WhisperCpp struct {
+	Path     string // whisper.cpp executable
+	Model    string // path of a ggml model
+	FFmpeg   string
+	Language string // detected if empty
+}
+
+func (w *WhisperCpp) Transcribe(ctx context.Context, path string) (string, error) {
+	wav := path + ".16k.wav"
+	defer os.Remove(wav)
+	out, err := exec.CommandContext(ctx, w.FFmpeg, "-y", "-loglevel", "error", "-i", path,
+		"-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le", wav).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("couldn't convert audio: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	language := w.Language
+	if language == "" {
+		language = "auto"
+	}
+	cmd := exec.CommandContext(ctx, w.Path, "-m", w.Model, "-f", wav, "-l", language, "-nt", "-np")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err = cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("whisper.cpp failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return strings.Join(strings.Fields(string(out)), " "), nil
+}
@@ -0,0 +1,77 @@
+package speech
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWhisperTranscribe(t *testing.T) {
+	var filename, model, audio string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil { // t.Fatal must not be called outside the test goroutine
+			t.Errorf("no file uploaded: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, _ := io.ReadAll(file)
+		filename, model, audio = header.Filename, r.FormValue("model"), string(data)
+		w.Write([]byte(`{"text": "  hello world\n"}`))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "telegram-123.oga")
+	if err := os.WriteFile(path, []byte("OggS"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := &Whisper{URL: server.URL, Key: "key", Model: "whisper-1"}
+	text, err := w.Transcribe(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "hello world" {
+		t.Errorf("text = %q, want %q", text, "hello world")
+	}
+	if filename != "telegram-123.ogg" {
+		t.Errorf("uploaded filename = %q, want telegram-123.ogg", filename)
+	}
+	if model != "whisper-1" || audio != "OggS" {
+		t.Errorf("model = %q, audio = %q", model, audio)
+	}
+}
+
+func TestWhisperTranscribeError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"message": "invalid file format"}}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "audio.mp3")
+	os.WriteFile(path, []byte("ID3"), 0644)
+	w := &Whisper{URL: server.URL, Model: "whisper-1"}
+	if _, err := w.Transcribe(context.Background(), path); err == nil {
+		t.Error("expected an error for status 400")
+	}
+}
+
+func TestUploadName(t *testing.T) {
+	for path, want := range map[string]string{
+		"/tmp/a.oga":  "a.ogg",
+		"/tmp/b.OPUS": "b.ogg",
+		"/tmp/c.mp3":  "c.mp3",
+		"d.ogg":       "d.ogg",
+	} {
+		if got := uploadName(path); got != want {
+			t.Errorf("uploadName(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
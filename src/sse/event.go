@@ -0,0 +1,137 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MAX_EVENT_SIZE = 1024 * 1024
+
+// Event is a message dispatched by an event stream. ID is the last event ID
+// seen in the stream, which may have been set by a previous event.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// Decoder reads events from a text/event-stream as specified by
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+type Decoder struct {
+	scanner     *bufio.Scanner
+	lastEventID string
+	retry       time.Duration
+	started     bool
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MAX_EVENT_SIZE)
+	scanner.Split(scanLines)
+	return &Decoder{scanner: scanner}
+}
+
+// Decode returns the next event of the stream. It returns io.EOF when the
+// stream ends; an incomplete event at the end of the stream is discarded.
+func (d *Decoder) Decode() (Event, error) {
+	var data strings.Builder
+	var eventType string
+	var hasData bool
+
+	for d.scanner.Scan() {
+		line := d.scanner.Text()
+		if !d.started {
+			line = strings.TrimPrefix(line, "\ufeff")
+			d.started = true
+		}
+
+		if len(line) == 0 { // dispatch the event
+			if !hasData {
+				eventType = ""
+				continue
+			}
+			if eventType == "" {
+				eventType = "message"
+			}
+			return Event{
+				ID:    d.lastEventID,
+				Event: eventType,
+				Data:  strings.TrimSuffix(data.String(), "\n"),
+				Retry: d.retry,
+			}, nil
+		}
+
+		if line[0] == ':' {
+			continue // comment or keep-alive
+		}
+
+		field, value, found := strings.Cut(line, ":")
+		if found {
+			value = strings.TrimPrefix(value, " ")
+		}
+
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				d.lastEventID = value
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 63); err == nil {
+				d.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+
+	if err := d.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+// LastEventID returns the ID to send in the Last-Event-ID header when
+// reconnecting to the stream.
+func (d *Decoder) LastEventID() string {
+	return d.lastEventID
+}
+
+// Retry returns the reconnection time requested by the server, if any.
+func (d *Decoder) Retry() time.Duration {
+	return d.retry
+}
+
+// scanLines splits a stream into lines terminated by CRLF, LF or CR.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		return 0, nil, nil // a LF may follow the CR
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
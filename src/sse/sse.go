@@ -2,6 +2,7 @@ package sse
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -18,111 +19,205 @@ import (
 	"golang.org/x/net/html"
 )
 
+const DONE = "[DONE]"
+
+// Chunk is a piece of output fed to the Telegram user. A chunk with Append
+// set is appended to the message currently being written, otherwise it
+// starts a new message. A chunk with a Photo, an Album or a Document is sent
+// as a separate message.
+type Chunk struct {
+	Text     string
+	Append   bool
+	Photo    string   // path or URL of an image
+	Album    []string // paths or URLs of images sent together
+	Document string   // path of a file
+}
+
 type Client struct {
 	URL          string
-	EventChannel chan []byte
+	EventChannel chan Event
 	Headers      map[string]string
+	LastEventID  string
+	Retry        time.Duration // delay before reconnecting to the stream
+	MaxRetries   int           // max reconnections when the stream is interrupted
 }
 
 func Init(url string) Client {
 	return Client{
 		URL:          url,
-		EventChannel: make(chan []byte),
+		EventChannel: make(chan Event),
+		Retry:        3 * time.Second,
 	}
 }
 
-func (c *Client) Connect(method string, params map[string]string, data any) error {
-	var body io.Reader
-	var err error
-
+// Connect sends the request and forwards the events of the response to
+// EventChannel, which is closed at the end of the stream. A response that is
+// not an event stream is forwarded as a single event. Cancelling ctx aborts
+// the request and closes EventChannel.
+func (c *Client) Connect(ctx context.Context, method string, params map[string]string, data any) error {
+	var payload []byte
 	if method == "POST" {
-		bs, _ := json.Marshal(&data)
-		body = strings.NewReader(string(bs))
-	} else {
-		body = nil
+		payload, _ = json.Marshal(&data)
 	}
 
-	req, err := http.NewRequest(method, c.URL, body)
+	resp, err := c.request(ctx, method, params, payload)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		return err
 	}
 
-	if len(params) > 0 {
-		q := req.URL.Query()
-		for k, v := range params {
-			q.Add(k, v)
+	go func() {
+		defer close(c.EventChannel)
+
+		for retries := 0; ; retries++ {
+			err := c.read(ctx, resp)
+			resp.Body.Close()
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			if retries >= c.MaxRetries {
+				log.Println(fmt.Errorf("failed to decode event: %v", err))
+				return
+			}
+			log.Printf("SSE stream interrupted: %v, reconnect %d/%d", err, retries+1, c.MaxRetries)
+			if sleep(ctx, c.Retry) != nil {
+				return
+			}
+			if resp, err = c.request(ctx, method, params, payload); err != nil {
+				log.Println(err)
+				return
+			}
 		}
-		req.URL.RawQuery = q.Encode()
-	}
+	}()
+
+	return nil
+}
 
-	for key, value := range c.Headers {
-		req.Header.Set(key, value)
+// sleep pauses for a duration, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
+func (c *Client) request(ctx context.Context, method string, params map[string]string, payload []byte) (*http.Response, error) {
 	var resp *http.Response
 
 	for i := 0; i < 5; i++ {
+		var body io.Reader
+		if payload != nil {
+			body = bytes.NewReader(payload)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, c.URL, body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+
+		if len(params) > 0 {
+			q := req.URL.Query()
+			for k, v := range params {
+				q.Add(k, v)
+			}
+			req.URL.RawQuery = q.Encode()
+		}
+
+		for key, value := range c.Headers {
+			req.Header.Set(key, value)
+		}
+		if c.LastEventID != "" {
+			req.Header.Set("Last-Event-ID", c.LastEventID)
+		}
+
 		http := &http.Client{}
 		resp, err = http.Do(req)
 		if err != nil {
-			break
+			return nil, err
 		} else if resp.StatusCode == 429 || resp.StatusCode == 400 {
 			log.Printf("failed to connect to SSE, retry %d/5", i+1)
+			resp.Body.Close()
 			i, _ := rand.Int(rand.Reader, big.NewInt(3000))
 			k := i.Int64() + 1000
-			time.Sleep(time.Duration(k) * time.Millisecond)
+			if err := sleep(ctx, time.Duration(k)*time.Millisecond); err != nil {
+				return nil, err
+			}
 		} else {
 			break
 		}
 	}
 
-	if err != nil {
-		return err
-	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("failed to connect to SSE: %v", resp.Status)
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to connect to SSE: %v", resp.Status)
 	}
+	return resp, nil
+}
 
-	go func() {
-		defer resp.Body.Close()
-		defer close(c.EventChannel)
-
-		for {
-			body, _ := ioutil.ReadAll(resp.Body)
+// read forwards the events of a response to EventChannel. It returns nil if
+// the stream ended normally.
+func (c *Client) read(ctx context.Context, resp *http.Response) error {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return c.emit(ctx, Event{Event: "message", Data: string(body)})
+	}
 
-			if err != nil {
-				log.Println(fmt.Errorf("failed to decode event: %v", err))
-				break
-			}
+	decoder := NewDecoder(resp.Body)
+	decoder.lastEventID = c.LastEventID
 
-			c.EventChannel <- body
+	for {
+		event, err := decoder.Decode()
+		c.LastEventID = decoder.LastEventID()
+		if decoder.Retry() > 0 {
+			c.Retry = decoder.Retry()
 		}
-	}()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if event.Data == DONE {
+			return nil
+		}
+		if err := c.emit(ctx, event); err != nil {
+			return err
+		}
+	}
+}
 
-	return nil
+// emit sends an event to EventChannel, unless ctx is done first.
+func (c *Client) emit(ctx context.Context, event Event) error {
+	select {
+	case c.EventChannel <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (c *Client) FeedForward(handler func(data []byte, feed chan string) (bool, error)) chan string {
-	var feed = make(chan string)
+func (c *Client) FeedForward(handler func(data []byte, feed chan Chunk) (bool, error)) chan Chunk {
+	var feed = make(chan Chunk)
 	var err error
 
 	go func() {
 		defer close(feed)
 		var done bool
 
-		for data := range c.EventChannel {
-			if len(data) == 0 {
-				if done {
-					return
-				} else {
-					continue
-				}
+		for event := range c.EventChannel {
+			if done || len(event.Data) == 0 {
+				continue // drain the remaining events
 			}
-			done, err = handler(data, feed)
+			done, err = handler([]byte(event.Data), feed)
 			if err != nil {
-				feed <- fmt.Sprintf("❌ %v", err)
+				feed <- Chunk{Text: fmt.Sprintf("❌ %v", err)}
 				log.Println(err)
-				return
+				done = true
 			}
 		}
 	}()
@@ -130,8 +225,8 @@ func (c *Client) FeedForward(handler func(data []byte, feed chan string) (bool,
 	return feed
 }
 
-func (c *Client) ExtractHtml(maxLen int) chan string {
-	return c.FeedForward(func(data []byte, feed chan string) (bool, error) {
+func (c *Client) ExtractHtml(maxLen int) chan Chunk {
+	return c.FeedForward(func(data []byte, feed chan Chunk) (bool, error) {
 		doc, _ := goquery.NewDocumentFromReader(bytes.NewReader(data))
 
 		doc.Find("a").Each(func(i int, el *goquery.Selection) {
@@ -173,16 +268,17 @@ func (c *Client) ExtractHtml(maxLen int) chan string {
 			`[^\w\d\s~!@#$%\^&*()\-=+\[\]{}|\\;:'",<.>/?]`,
 		).ReplaceAllString(content, "")
 
-		feed <- content
+		feed <- Chunk{Text: content}
 		return true, nil
 	})
 }
 
-func Fetch(url string) ([]byte, error) {
+func Fetch(ctx context.Context, url string) ([]byte, error) {
 	client := Init(url)
-	err := client.Connect("GET", map[string]string{}, nil)
+	err := client.Connect(ctx, "GET", map[string]string{}, nil)
 	if err != nil {
 		return nil, err
 	}
-	return <-client.EventChannel, nil
+	event := <-client.EventChannel
+	return []byte(event.Data), nil
 }
@@ -0,0 +1,246 @@
+package sse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func decodeAll(t *testing.T, stream string) []Event {
+	t.Helper()
+	d := NewDecoder(strings.NewReader(stream))
+	var events []Event
+	for {
+		event, err := d.Decode()
+		if err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []Event
+	}{
+		{
+			name:   "single line",
+			stream: "data: hello\n\n",
+			want:   []Event{{Event: "message", Data: "hello"}},
+		},
+		{
+			name:   "multi-line data",
+			stream: "data: first\ndata:second\ndata\ndata:  third\n\n",
+			want:   []Event{{Event: "message", Data: "first\nsecond\n\n third"}},
+		},
+		{
+			name:   "event type",
+			stream: "event: update\ndata: 1\n\ndata: 2\n\n",
+			want:   []Event{{Event: "update", Data: "1"}, {Event: "message", Data: "2"}},
+		},
+		{
+			name:   "id and retry",
+			stream: "id: 7\nretry: 1500\ndata: a\n\ndata: b\n\nid\ndata: c\n\nretry: soon\ndata: d\n\n",
+			want: []Event{
+				{ID: "7", Event: "message", Data: "a", Retry: 1500 * time.Millisecond},
+				{ID: "7", Event: "message", Data: "b", Retry: 1500 * time.Millisecond},
+				{ID: "", Event: "message", Data: "c", Retry: 1500 * time.Millisecond},
+				{ID: "", Event: "message", Data: "d", Retry: 1500 * time.Millisecond},
+			},
+		},
+		{
+			name:   "comments and keep-alives",
+			stream: ": keep-alive\n\n:\ndata: x\n: inside\n\n: ping\n\n",
+			want:   []Event{{Event: "message", Data: "x"}},
+		},
+		{
+			name:   "event without data",
+			stream: "event: empty\n\ndata: y\n\n",
+			want:   []Event{{Event: "message", Data: "y"}},
+		},
+		{
+			name:   "BOM and CRLF",
+			stream: "\ufeffdata: a\r\ndata: b\r\n\r\nid: 2\rdata: c\r\r",
+			want: []Event{
+				{Event: "message", Data: "a\nb"},
+				{ID: "2", Event: "message", Data: "c"},
+			},
+		},
+		{
+			name:   "BOM only at the start",
+			stream: "\ufeffdata: a\n\n\ufeffdata: b\n\n",
+			want:   []Event{{Event: "message", Data: "a"}},
+		},
+		{
+			name:   "EOF without a trailing blank line",
+			stream: "data: complete\n\ndata: incomplete\n",
+			want:   []Event{{Event: "message", Data: "complete"}},
+		},
+		{
+			name:   "EOF in the middle of a line",
+			stream: "data: complete\n\ndata: incompl",
+			want:   []Event{{Event: "message", Data: "complete"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeAll(t, tt.stream); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// collect reads the events of a client until its channel is closed.
+func collect(t *testing.T, c *Client) []string {
+	t.Helper()
+	var data []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-c.EventChannel:
+			if !ok {
+				return data
+			}
+			data = append(data, event.Data)
+		case <-timeout:
+			t.Fatal("the event channel was not closed")
+		}
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Authorization") != "Bearer key" {
+			t.Errorf("unexpected request: %s %v", r.Method, r.Header)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{"data: {\"n\":1}\n\n", ": keep-alive\n\n", "data: {\"n\":", "2}\n\n", "data: [DONE]\n\n", "data: ignored\n\n"} {
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	c := Init(server.URL)
+	c.Headers = map[string]string{"Authorization": "Bearer key"}
+	if err := c.Connect(context.Background(), "POST", nil, map[string]string{"a": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`{"n":1}`, `{"n":2}`}
+	if got := collect(t, &c); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClientClosesOnEOF(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		io.WriteString(w, "data: one\n\ndata: two\n\ndata: unterminated")
+	}))
+	defer server.Close()
+
+	c := Init(server.URL)
+	if err := c.Connect(context.Background(), "GET", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := collect(t, &c), []string{"one", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClientNonStreamResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") != "x" {
+			t.Errorf("query = %q", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{\"a\": 1}\n\n{\"b\": 2}")
+	}))
+	defer server.Close()
+
+	c := Init(server.URL)
+	if err := c.Connect(context.Background(), "GET", map[string]string{"q": "x"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := collect(t, &c), []string{"{\"a\": 1}\n\n{\"b\": 2}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClientReconnectsWithLastEventID(t *testing.T) {
+	var mu sync.Mutex
+	var lastEventIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		attempt := len(lastEventIDs)
+		mu.Unlock()
+
+		if attempt == 1 {
+			// interrupt the stream: the connection is closed before the end
+			// of the chunked body
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			body := "retry: 10\nid: 1\ndata: first\n\n"
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n"+
+				"Transfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n", len(body), body)
+			buf.Flush()
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "id: 2\ndata: second\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	c := Init(server.URL)
+	c.MaxRetries = 1
+	if err := c.Connect(context.Background(), "GET", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := collect(t, &c), []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if want := []string{"", "1"}; !reflect.DeepEqual(lastEventIDs, want) {
+		t.Errorf("Last-Event-ID headers = %q, want %q", lastEventIDs, want)
+	}
+	if c.LastEventID != "2" || c.Retry != 10*time.Millisecond {
+		t.Errorf("LastEventID = %q, Retry = %v", c.LastEventID, c.Retry)
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; r.Context().Err() == nil; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := Init(server.URL)
+	if err := c.Connect(ctx, "GET", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-c.EventChannel
+	cancel()
+	collect(t, &c)
+}
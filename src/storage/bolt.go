@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tztsai/openai-telegram/src/openai"
+	bolt "go.etcd.io/bbolt"
+)
+
+var CHATS_BUCKET = []byte("chats")
+
+// Bolt stores each conversation as a JSON document, in the same format as
+// the history files, in an embedded BoltDB database.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the database at path, creating it if missing. A new
+// database is filled with the conversations saved by /save in the history
+// directory as chat_<chat ID>.json files, so they are imported only once.
+func OpenBolt(path string, history string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(CHATS_BUCKET) != nil {
+			return nil
+		}
+		bucket, err := tx.CreateBucket(CHATS_BUCKET)
+		if err != nil {
+			return err
+		}
+		return importHistory(bucket, history)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Bolt{db: db}, nil
+}
+
+// importHistory puts the conversations of the history files in bucket.
+func importHistory(bucket *bolt.Bucket, history string) error {
+	files, err := filepath.Glob(filepath.Join(history, "chat_*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		chatID, err := strconv.ParseInt(strings.TrimPrefix(name, "chat_"), 10, 64)
+		if err != nil {
+			continue // saved under another name by /save
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var convo openai.Conversation
+		if err := json.Unmarshal(data, &convo); err != nil {
+			log.Printf("Couldn't import %s: %v", file, err)
+			continue
+		}
+		if data, err = json.Marshal(convo); err != nil {
+			return err
+		}
+		if err := bucket.Put(chatKey(chatID), data); err != nil {
+			return err
+		}
+		log.Printf("Imported conversation %d from %s", chatID, file)
+	}
+	return nil
+}
+
+func (b *Bolt) Save(chatID int64, convo openai.Conversation) error {
+	data, err := json.Marshal(convo)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(CHATS_BUCKET).Put(chatKey(chatID), data)
+	})
+}
+
+func (b *Bolt) Delete(chatID int64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(CHATS_BUCKET).Delete(chatKey(chatID))
+	})
+}
+
+func (b *Bolt) LoadAll() (map[int64]openai.Conversation, error) {
+	convos := make(map[int64]openai.Conversation)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(CHATS_BUCKET).ForEach(func(k, v []byte) error {
+			chatID, err := strconv.ParseInt(string(k), 10, 64)
+			if err != nil {
+				return err
+			}
+			var convo openai.Conversation
+			if err := json.Unmarshal(v, &convo); err != nil {
+				return err
+			}
+			convos[chatID] = convo
+			return nil
+		})
+	})
+	return convos, err
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+func chatKey(chatID int64) []byte {
+	return []byte(strconv.FormatInt(chatID, 10))
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenBoltImportsHistoryOnce(t *testing.T) {
+	history := t.TempDir()
+	files := map[string]string{
+		"chat_42.json":  `{"Messages": [{"role": "user", "content": "hello"}]}`,
+		"chat_-7.json":  `{"Summary": "group"}`,
+		"ckpt1.json":    `{"Summary": "not a chat"}`,
+		"chat_bad.json": `{}`,
+		"chat_9.json":   `not json`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(history, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(history, "chats.db")
+
+	db, err := OpenBolt(path, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	convos, err := db.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convos) != 2 {
+		t.Errorf("imported %d conversations, want 2", len(convos))
+	}
+	if msgs := convos[42].Messages; len(msgs) != 1 || msgs[0].Content != "hello" {
+		t.Errorf("imported chat 42 with messages %+v", msgs)
+	}
+	if convos[-7].Summary != "group" {
+		t.Errorf("imported chat -7 with summary %q", convos[-7].Summary)
+	}
+	if err := db.Delete(42); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// the files are not imported again into an existing database
+	db, err = OpenBolt(path, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	convos, err = db.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := convos[42]; ok || len(convos) != 1 {
+		t.Errorf("reopened database has %d conversations", len(convos))
+	}
+}
@@ -1,17 +1,23 @@
+import io
+import os
 import sys
 import ssl
-import code
+import ast
+import json
+import time
+import linecache
+import traceback
+import signal
+import argparse
 import builtins
 import requests
+from contextlib import redirect_stdout, redirect_stderr
 from importlib import import_module
 from restricted import safe_globals
 
 ssl._create_default_https_context = ssl._create_unverified_context
 
 
-ETX = chr(3)  # End of text, Ctrl-C
-EOT = chr(4)  # End of transmission, Ctrl-D
-
 safe_modules = {
     'math', 'random', 'time', 'datetime', 'json', 're', 
     'itertools', 'functools', 'operator', 'collections', 
@@ -33,28 +39,187 @@ def fetch(url, method='GET', headers=None, params=None, data=None, json=None):
     response.raise_for_status() # raises exception if the status code is not 200 OK
     return response.text
 
-def read_line():
-    buf = []
-    while 1:
-        c = sys.stdin.read(1)
-        if not c or c == EOT:
-            raise KeyboardInterrupt
-        if c in (ETX, '\n'):
-            break
-        buf.append(c)
-    return ''.join(buf), c
+try:
+    import resource  # unavailable on Windows
+except ImportError:
+    resource = None
+
+SPAWN_EVENTS = {
+    'subprocess.Popen', 'os.system', 'os.exec', 'os.posix_spawn',
+    'os.spawn', 'os.fork', 'os.forkpty', 'os.startfile', 'pty.spawn',
+}
+NETWORK_EVENTS = {
+    'socket.connect', 'socket.bind', 'socket.sendto', 'socket.sendmsg',
+    'socket.getaddrinfo', 'socket.gethostbyname', 'socket.gethostbyaddr',
+}
+FILE_EVENTS = {  # events whose path arguments are written
+    'os.remove', 'os.rename', 'os.rmdir', 'os.mkdir', 'os.chmod', 'os.chown',
+    'os.link', 'os.symlink', 'os.truncate', 'os.utime', 'shutil.rmtree',
+    'shutil.move', 'shutil.copyfile',
+}
+WRITE_FLAGS = os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREAT | os.O_TRUNC
+
+
+class CPUTimeExceeded(Exception):
+    pass
+
+
+def limit_memory(mb):
+    if resource:
+        limit = mb * 1024 * 1024
+        resource.setrlimit(resource.RLIMIT_AS, (limit, limit))
+
+def limit_cpu_time(seconds):
+    """Limit the CPU time from now on, or remove the limit if seconds is None."""
+    if not resource:
+        return
+    _, hard = resource.getrlimit(resource.RLIMIT_CPU)
+    if seconds is None:
+        resource.setrlimit(resource.RLIMIT_CPU, (hard, hard))
+        return
+    usage = resource.getrusage(resource.RUSAGE_SELF)
+    soft = int(usage.ru_utime + usage.ru_stime) + seconds
+    if hard != resource.RLIM_INFINITY:
+        soft = min(soft, hard)
+    resource.setrlimit(resource.RLIMIT_CPU, (soft, hard))
+
+def on_cpu_time_exceeded(signum, frame):
+    limit_cpu_time(None)
+    raise CPUTimeExceeded('CPU time limit exceeded')
+
+def sandbox(no_network, no_files):
+    """Forbid network and file access outside the working directory with an
+    audit hook, which can't be removed once added."""
+    workdir = os.path.realpath(os.getcwd())
+    readable = {os.path.realpath(p) for p in sys.path + [sys.prefix, sys.base_prefix] if p}
+    readable.add(workdir)
+
+    def inside(path, dirs):
+        if isinstance(path, int) or path is None:
+            return True  # file descriptor
+        path = os.path.realpath(os.fsdecode(path))
+        return any(path == d or path.startswith(d + os.sep) for d in dirs)
+
+    def hook(event, args):
+        if event in SPAWN_EVENTS:
+            raise PermissionError(f'{event} is not allowed in the sandbox')
+        if no_network and event in NETWORK_EVENTS:
+            raise PermissionError('network access is not allowed in the sandbox')
+        if not no_files:
+            return
+        if event == 'open':
+            path, _, flags = args
+            dirs = [workdir] if flags & WRITE_FLAGS else readable
+            if not inside(path, dirs):
+                raise PermissionError(f'access to {path} is not allowed in the sandbox')
+        elif event in FILE_EVENTS:
+            for path in args:
+                if isinstance(path, (str, bytes, os.PathLike)) and not inside(path, [workdir]):
+                    raise PermissionError(f'access to {path} is not allowed in the sandbox')
+        elif event in ('os.listdir', 'os.scandir'):
+            if not inside(args[0] or '.', readable):
+                raise PermissionError(f'access to {args[0]} is not allowed in the sandbox')
+
+    sys.dont_write_bytecode = True
+    sys.addaudithook(hook)
+
+
+def read_frame():
+    """Read a message from stdin: a JSON object preceded by its length as a
+    32-bit big-endian integer. Return None at the end of the input."""
+    header = sys.stdin.buffer.read(4)
+    if len(header) < 4:
+        return None
+    size = int.from_bytes(header, 'big')
+    return json.loads(sys.stdin.buffer.read(size))
+
+frames = None  # where the frames are written, see open_frames
 
+def open_frames():
+    """Keep a private copy of stdout for the frames, and send the output
+    written directly to fd 1 by the code (os.write, C extensions) to stderr,
+    so that it can't corrupt them."""
+    global frames
+    sys.stdout.flush()
+    frames = os.fdopen(os.dup(1), 'wb')
+    os.dup2(2, 1)
 
-class PythonConsole(code.InteractiveConsole):
+def write_frame(msg):
+    data = json.dumps(msg).encode()
+    frames.write(len(data).to_bytes(4, 'big') + data)
+    frames.flush()
+
+def format_exception(e, filename):
+    """Format an exception raised by the code in filename, without the frames
+    of the console."""
+    frames = list(traceback.extract_tb(e.__traceback__))
+    while frames and frames[0].filename != filename:
+        frames.pop(0)  # compiling the code
+    frames = [f for f in frames if f.filename != __file__]
+    lines = traceback.format_list(frames)
+    if lines:
+        lines.insert(0, 'Traceback (most recent call last):\n')
+    lines += traceback.format_exception_only(type(e), e)
+    return {
+        'type': type(e).__name__,
+        'message': str(e),
+        'traceback': ''.join(lines),
+    }
+
+def list_files(root='.'):
+    """Return the modification times of the files in a directory, except the
+    hidden ones."""
+    files = {}
+    for entry in os.scandir(root):
+        if entry.name.startswith('.'):
+            continue
+        if entry.is_dir(follow_symlinks=False):
+            files.update(list_files(entry.path))
+        elif entry.is_file(follow_symlinks=False):
+            files[os.path.relpath(entry.path)] = entry.stat().st_mtime_ns
+    return files
+
+def truncate(text, max_len):
+    if max_len and len(text) > max_len:
+        return text[:max_len] + f'\n... (output truncated to {max_len} characters)'
+    return text
+
+
+class Output:
+    """The output of a piece of code: its stdout, stderr, and the figures and
+    files it produced."""
+
+    def __init__(self):
+        self.stdout = io.StringIO()
+        self.stderr = io.StringIO()
+        self.files = list_files()
+
+    def result(self, figures, max_len):
+        files = list_files()
+        written = [f for f, t in files.items() if self.files.get(f) != t and f not in figures]
+        return {
+            'stdout': truncate(self.stdout.getvalue(), max_len),
+            'stderr': truncate(self.stderr.getvalue(), max_len),
+            'images': figures,
+            'files': sorted(written),
+        }
+
+
+class PythonConsole:
     name = 'Python Console'
+    filename = '<console>'
     
-    def __init__(self, namespace=None, filename="<console>"):
-        super().__init__(namespace, filename)
+    def __init__(self, cpu_time=None, max_output=None):
+        self.namespace = {'__name__': '__console__', '__builtins__': builtins}
+        self.cpu_time = cpu_time
+        self.max_output = max_output
+        self.running = False  # whether code is being run
+        self.figures = 0  # number of saved figures
         # self.compile = compile_restricted
-        # self.locals = safe_globals
-        # self.locals['__builtins__'].update(
+        # self.namespace = safe_globals
+        # self.namespace['__builtins__'].update(
         #     print=print, __import__=safe_import, vars=vars,
-        #     globals=lambda: self.locals, locals=locals, 
+        #     globals=lambda: self.namespace, locals=locals, 
         #     min=min, max=max, dict=dict, list=list, iter=iter,
         #     sum=sum, all=all, any=any, map=map, filter=filter,
         #     enumerate=enumerate, getattr=getattr, hasattr=hasattr,
@@ -62,37 +227,97 @@ class PythonConsole(code.InteractiveConsole):
         # )
 
     def interact(self):
+        """Reply to each request read from stdin with the result of its code."""
+        signal.signal(signal.SIGINT, self.on_interrupt)
         self.info('Started')
-        
-        more = False
         while 1:
-            try:
-                line, end = read_line()
-            except KeyboardInterrupt:
-                self.resetbuffer()
+            request = read_frame()
+            if request is None:
                 break
-            
-            if more and (end == ETX or line and not line[0].isspace()):
-                self.push('\n\n')  # end an indent block
-
-            more = self.push(line)
-            
-            if end == ETX:  # end of message
-                if more:  # incomplete 
-                    self.write("SyntaxError: unexpected EOF while parsing\n"+ETX)
-                    self.resetbuffer()
-                else:
-                    self.info("Finished computing")
-                    self.write(ETX)
-
+            write_frame(self.run(request['code']))
+            self.info('Finished computing')
         self.info('Exited')
 
-    def write(self, data):
-        sys.stdout.write(data)
-        sys.stdout.flush()
+    def on_interrupt(self, signum, frame):
+        if self.running:  # ignore the interrupts arriving too late
+            raise KeyboardInterrupt
+
+    def run(self, source):
+        output = Output()
+        value = exception = None
+        start = time.perf_counter()
+        with redirect_stdout(output.stdout), redirect_stderr(output.stderr):
+            try:
+                if self.cpu_time:
+                    limit_cpu_time(self.cpu_time)
+                self.running = True
+                value = self.execute(source)
+            except BaseException as e:  # including SystemExit and KeyboardInterrupt
+                exception = format_exception(e, self.filename)
+            finally:
+                self.running = False
+                if self.cpu_time:
+                    limit_cpu_time(None)
+        result = output.result(self.save_figures(), self.max_output)
+        result.update(
+            value=truncate(value, self.max_output) if value is not None else '',
+            exception=exception,
+            time=time.perf_counter() - start,
+        )
+        return result
+
+    def execute(self, source):
+        """Run a piece of code and return the repr of its last statement if it
+        is an expression, like a cell of a notebook."""
+        linecache.cache[self.filename] = (len(source), None, source.splitlines(True), self.filename)
+        tree = ast.parse(source, self.filename, 'exec')
+        last = None
+        if tree.body and isinstance(tree.body[-1], ast.Expr):
+            last = ast.Expression(tree.body.pop().value)
+        exec(compile(tree, self.filename, 'exec'), self.namespace)
+        if last is not None:
+            value = eval(compile(last, self.filename, 'eval'), self.namespace)
+            if value is not None:
+                self.namespace['_'] = value
+                return repr(value)
+        return None
+
+    def save_figures(self):
+        """Save the open figures of matplotlib as PNG images and close them."""
+        plt = sys.modules.get('matplotlib.pyplot')
+        if plt is None:
+            return []
+        paths = []
+        for num in plt.get_fignums():
+            self.figures += 1
+            path = f'figure-{self.figures}.png'
+            try:
+                plt.figure(num).savefig(path)
+                paths.append(path)
+            except Exception as e:
+                self.info(f'Failed to save figure {num}: {e}')
+        plt.close('all')
+        return paths
 
     def info(self, data):
-        sys.stderr.write(f"{self.name}: {data}\n")
+        sys.__stderr__.write(f"{self.name}: {data}\n")
+
+
+if __name__ == '__main__':
+    parser = argparse.ArgumentParser()
+    parser.add_argument('--cpu-time', type=int, help='CPU seconds per message')
+    parser.add_argument('--memory', type=int, help='address space in MB')
+    parser.add_argument('--no-network', action='store_true')
+    parser.add_argument('--no-files', action='store_true')
+    parser.add_argument('--max-output', type=int, help='characters of stdout and stderr per message')
+    args = parser.parse_args()
 
+    open_frames()
+    if args.memory:
+        limit_memory(args.memory)
+    if args.cpu_time and resource:
+        signal.signal(signal.SIGXCPU, on_cpu_time_exceeded)
+    if args.no_network or args.no_files:
+        sandbox(args.no_network, args.no_files)
 
-PythonConsole().interact()
+    PythonConsole(cpu_time=args.cpu_time, max_output=args.max_output).interact()
@@ -0,0 +1,176 @@
+package subproc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tztsai/openai-telegram/src/plugin"
+)
+
+// PythonPool is the Python plugin, running the queries of each chat in an
+// interpreter of its own. Interpreters are started on the first query of a
+// chat and stopped after being idle for TTL.
+type PythonPool struct {
+	PythonPath string
+	Sandbox    Sandbox
+	TTL        time.Duration // idle time before stopping an interpreter, 0 for never
+	MaxLive    int           // max number of running interpreters, 0 for no limit
+
+	mu       sync.Mutex
+	sessions map[int64]*session
+	done     chan struct{}
+}
+
+type session struct {
+	python   *Python
+	busy     int // number of queries being run
+	lastUsed time.Time
+}
+
+func NewPythonPool(pythonPath string, sandbox Sandbox, ttl time.Duration, maxLive int) *PythonPool {
+	pool := &PythonPool{
+		PythonPath: pythonPath,
+		Sandbox:    sandbox,
+		TTL:        ttl,
+		MaxLive:    maxLive,
+		sessions:   make(map[int64]*session),
+		done:       make(chan struct{}),
+	}
+	if ttl > 0 {
+		go pool.evictIdle()
+	}
+	return pool
+}
+
+func (pool *PythonPool) Name() string {
+	return "Python"
+}
+
+func (pool *PythonPool) Aliases() []string {
+	return []string{"py", "python"}
+}
+
+func (pool *PythonPool) Description() string {
+	return "Runs a piece of Python code in an external interpreter and returns its stdout, stderr, errors and the value of its last expression. The figures of matplotlib and the files written in the working directory are sent to the user. Variables are kept between queries."
+}
+
+func (pool *PythonPool) InputSchema() map[string]any {
+	return plugin.StringSchema("The Python code to run.")
+}
+
+// Run runs a query in the interpreter of the chat given by ctx.
+func (pool *PythonPool) Run(ctx context.Context, query string) (plugin.Result, error) {
+	chatID := plugin.ChatID(ctx)
+	s, err := pool.acquire(chatID)
+	if err != nil {
+		return plugin.Result{}, err
+	}
+	defer pool.release(s)
+	return s.python.Run(ctx, query)
+}
+
+// acquire returns the session of a chat, starting its interpreter if needed,
+// and marks it as busy.
+func (pool *PythonPool) acquire(chatID int64) (*session, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	s, ok := pool.sessions[chatID]
+	if !ok {
+		if pool.MaxLive > 0 && len(pool.sessions) >= pool.MaxLive && !pool.evictLRU() {
+			return nil, fmt.Errorf("all %d Python interpreters are busy, try again later", pool.MaxLive)
+		}
+		python, err := NewPython(pool.PythonPath, pool.Sandbox)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Started Python interpreter of chat %d", chatID)
+		s = &session{python: python}
+		pool.sessions[chatID] = s
+	}
+	s.busy++
+	s.lastUsed = time.Now()
+	return s, nil
+}
+
+func (pool *PythonPool) release(s *session) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	s.busy--
+	s.lastUsed = time.Now()
+}
+
+// evictLRU stops the least recently used idle interpreter. It returns false
+// if every interpreter is busy. The caller must hold the lock.
+func (pool *PythonPool) evictLRU() bool {
+	var lru int64
+	var found bool
+	for chatID, s := range pool.sessions {
+		if s.busy == 0 && (!found || s.lastUsed.Before(pool.sessions[lru].lastUsed)) {
+			lru, found = chatID, true
+		}
+	}
+	if found {
+		pool.stop(lru)
+	}
+	return found
+}
+
+// stop stops the interpreter of a chat. The caller must hold the lock.
+func (pool *PythonPool) stop(chatID int64) {
+	s := pool.sessions[chatID]
+	delete(pool.sessions, chatID)
+	log.Printf("Stopping Python interpreter of chat %d", chatID)
+	go s.python.Close() // waits for the queries being run
+}
+
+func (pool *PythonPool) evictIdle() {
+	ticker := time.NewTicker(pool.TTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pool.mu.Lock()
+			for chatID, s := range pool.sessions {
+				if s.busy == 0 && time.Since(s.lastUsed) > pool.TTL {
+					pool.stop(chatID)
+				}
+			}
+			pool.mu.Unlock()
+		case <-pool.done:
+			return
+		}
+	}
+}
+
+// Reset stops the interpreter of a chat, so that its next query starts a new
+// one. It returns false if the chat has no interpreter.
+func (pool *PythonPool) Reset(chatID int64) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	_, ok := pool.sessions[chatID]
+	if ok {
+		pool.stop(chatID)
+	}
+	return ok
+}
+
+// Close stops every interpreter.
+func (pool *PythonPool) Close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	close(pool.done)
+	var wg sync.WaitGroup
+	for chatID, s := range pool.sessions {
+		delete(pool.sessions, chatID)
+		wg.Add(1)
+		go func(python *Python) {
+			defer wg.Done()
+			python.Close()
+		}(s.python)
+	}
+	wg.Wait()
+}
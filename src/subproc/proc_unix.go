@@ -0,0 +1,39 @@
+//go:build !windows
+
+package subproc
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+func setProcAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// interrupt sends SIGINT to the process, as Ctrl-C does.
+func interrupt(cmd *exec.Cmd) error {
+	return cmd.Process.Signal(os.Interrupt)
+}
+
+// kill kills the process group of the process.
+func kill(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// limitedCommand returns a command limited in CPU time and address space by
+// a shell, which then replaces itself with the command.
+func limitedCommand(path string, args []string, cpuTime time.Duration, memory int) *exec.Cmd {
+	script := `exec "$0" "$@"`
+	if memory > 0 {
+		script = fmt.Sprintf("ulimit -v %d 2>/dev/null; %s", memory*1024, script)
+	}
+	if seconds := int(math.Ceil(cpuTime.Seconds())); seconds > 0 {
+		script = fmt.Sprintf("ulimit -t %d 2>/dev/null; %s", seconds, script)
+	}
+	return exec.Command("/bin/sh", append([]string{"-c", script, path}, args...)...)
+}
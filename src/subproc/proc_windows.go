@@ -0,0 +1,27 @@
+//go:build windows
+
+package subproc
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+)
+
+func setProcAttr(cmd *exec.Cmd) {}
+
+// interrupt is unsupported on Windows, where console processes can only be
+// interrupted from their own console.
+func interrupt(cmd *exec.Cmd) error {
+	return errors.New("interrupt is not supported on Windows")
+}
+
+func kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// limitedCommand returns the command, since resource limits are unsupported
+// on Windows.
+func limitedCommand(path string, args []string, cpuTime time.Duration, memory int) *exec.Cmd {
+	return exec.Command(path, args...)
+}
@@ -0,0 +1,146 @@
+package subproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tztsai/openai-telegram/src/plugin"
+)
+
+const CONSOLE_PATH = "src/subproc/console.py"
+
+// MAX_FILE_SIZE is the max size of the files sent to Telegram by a bot.
+const MAX_FILE_SIZE = 50 << 20
+
+var CODE_BLOCK_PAT = regexp.MustCompile("```(py.*)?([\\s\\S]*)\\s*```")
+
+// Sandbox limits the code run by the Python plugin. Zero values mean no
+// limit. The CPU, memory, network and file limits are enforced by the
+// console and are best-effort: the resource limits are unavailable on
+// Windows, and native extensions can bypass the network and file checks.
+type Sandbox struct {
+	Timeout   time.Duration // wall-clock time of a query
+	CPUTime   time.Duration // CPU time of a query
+	Memory    int           // address space of the interpreter in MB
+	MaxOutput int           // characters of stdout, stderr and value per query
+	NoNetwork bool          // forbid sockets
+	NoFiles   bool          // forbid file access outside the working directory
+}
+
+// Python is a Python interpreter used as a plugin. It runs in a temporary
+// working directory and is restarted when a query times out.
+type Python struct {
+	*Subproc
+	Sandbox Sandbox
+}
+
+func NewPython(pythonPath string, sandbox Sandbox) (*Python, error) {
+	console, err := filepath.Abs(CONSOLE_PATH)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "python-")
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{console}
+	if sandbox.CPUTime > 0 {
+		args = append(args, "--cpu-time", strconv.Itoa(int(math.Ceil(sandbox.CPUTime.Seconds()))))
+	}
+	if sandbox.Memory > 0 {
+		args = append(args, "--memory", strconv.Itoa(sandbox.Memory))
+	}
+	if sandbox.NoNetwork {
+		args = append(args, "--no-network")
+	}
+	if sandbox.NoFiles {
+		args = append(args, "--no-files")
+	}
+	if sandbox.MaxOutput > 0 {
+		args = append(args, "--max-output", strconv.Itoa(sandbox.MaxOutput))
+	}
+
+	p := &Subproc{
+		Command: pythonPath,
+		Args:    args,
+		Dir:     dir,
+		Env: []string{
+			"MPLBACKEND=Agg",
+			// keep the caches of matplotlib in the working directory
+			"MPLCONFIGDIR=" + filepath.Join(dir, ".matplotlib"),
+		},
+		Timeout: sandbox.Timeout,
+	}
+	if err := p.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &Python{p, sandbox}, nil
+}
+
+// Run runs a piece of code, possibly in a Markdown code block. The figures
+// and files it produces are attached to the result, and mentioned in its
+// text for the model.
+func (p *Python) Run(ctx context.Context, query string) (plugin.Result, error) {
+	if match := CODE_BLOCK_PAT.FindStringSubmatch(query); len(match) > 0 {
+		query = match[2]
+	}
+	out, err := p.Send(ctx, query)
+	if errors.Is(err, ErrTimeout) {
+		return plugin.Result{Text: fmt.Sprintf(
+			"Error: execution timed out after %v. The interpreter was restarted, so all variables were lost.",
+			p.Sandbox.Timeout)}, nil
+	} else if err != nil {
+		return plugin.Result{}, err
+	}
+
+	var res plugin.Result
+	var lines []string
+	if stdout := strings.TrimSpace(out.Stdout); stdout != "" {
+		lines = append(lines, stdout)
+	}
+	if stderr := strings.TrimSpace(out.Stderr); stderr != "" {
+		lines = append(lines, "stderr:\n"+stderr)
+	}
+	if out.Exception != nil {
+		lines = append(lines, strings.TrimSpace(out.Exception.Traceback))
+	} else if out.Value != "" {
+		lines = append(lines, "Out: "+out.Value)
+	}
+	if out.Time >= 1 {
+		lines = append(lines, fmt.Sprintf("[Executed in %.1f s.]", out.Time))
+	}
+	for _, image := range out.Images {
+		res.Images = append(res.Images, filepath.Join(p.Dir, image))
+		lines = append(lines, fmt.Sprintf("[The figure %s was shown to the user.]", image))
+	}
+	for _, file := range out.Files {
+		path := filepath.Join(p.Dir, file)
+		if info, err := os.Stat(path); err != nil || info.Size() > MAX_FILE_SIZE {
+			lines = append(lines, fmt.Sprintf("[The file %s was written, but is too large to send.]", file))
+			continue
+		}
+		res.Files = append(res.Files, path)
+		lines = append(lines, fmt.Sprintf("[The file %s was written and sent to the user.]", file))
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "[Executed without output.]")
+	}
+	res.Text = strings.Join(lines, "\n")
+	return res, nil
+}
+
+// Close stops the interpreter and removes its working directory.
+func (p *Python) Close() {
+	p.Subproc.Close()
+	os.RemoveAll(p.Dir)
+}
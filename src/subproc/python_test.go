@@ -0,0 +1,64 @@
+package subproc
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// startConsole starts console.py with the Python of the PATH, skipping the
+// test if there is none.
+func startConsole(t *testing.T, args ...string) *Subproc {
+	t.Helper()
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not found")
+	}
+	console, err := filepath.Abs("console.py")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Subproc{Command: python, Args: append([]string{console}, args...), Dir: t.TempDir()}
+	if exec.Command(python, "-c", "import requests").Run() != nil {
+		// the console only needs the module to be importable
+		stub := t.TempDir()
+		if err := os.WriteFile(filepath.Join(stub, "requests.py"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		p.Env = []string{"PYTHONPATH=" + stub}
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestConsoleSurvivesWritesToStdout(t *testing.T) {
+	p := startConsole(t)
+	pid := p.Cmd.Process.Pid
+	for _, code := range []string{
+		"import os, sys\nos.write(1, b'hello')\nx = 1",
+		"sys.__stdout__.write('bye'); sys.__stdout__.flush()",
+	} {
+		res, err := p.Send(context.Background(), code)
+		if err != nil {
+			t.Fatalf("%q: %v", code, err)
+		}
+		if res.Exception != nil {
+			t.Fatalf("%q raised %s", code, res.Exception.Traceback)
+		}
+	}
+	res, err := p.Send(context.Background(), "print(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stdout != "1\n" {
+		t.Errorf("stdout = %q, want the variable of the session", res.Stdout)
+	}
+	if p.Cmd.Process.Pid != pid {
+		t.Error("the interpreter was restarted")
+	}
+}
@@ -0,0 +1,274 @@
+package subproc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tztsai/openai-telegram/src/plugin"
+)
+
+// DEFAULT_COMMANDS are the commands allowed in the shell by default.
+var DEFAULT_COMMANDS = []string{
+	"echo", "date", "cal", "ls", "cat", "head", "tail", "wc", "grep",
+	"sort", "uniq", "cut", "tr", "seq", "bc", "uname", "pwd",
+}
+
+// Shell is a plugin running commands of an allowlist. Commands are not run
+// by a shell: pipes, redirections and expansions are unsupported. Each one
+// runs in a new temporary directory, with limited time and memory, and can
+// only be given paths inside it.
+type Shell struct {
+	Commands  []string      // allowed commands
+	Timeout   time.Duration // wall-clock and CPU time of a command
+	Memory    int           // address space of a command in MB, 0 for no limit
+	MaxOutput int           // bytes of output returned per command
+	Tool      bool          // whether admins expose the shell to the model
+}
+
+func NewShell(commands []string, timeout time.Duration, memory int, tool bool) *Shell {
+	if len(commands) == 0 {
+		commands = DEFAULT_COMMANDS
+	}
+	return &Shell{
+		Commands:  commands,
+		Timeout:   timeout,
+		Memory:    memory,
+		MaxOutput: 16000,
+		Tool:      tool,
+	}
+}
+
+func (s *Shell) Name() string {
+	return "Shell"
+}
+
+func (s *Shell) Aliases() []string {
+	return []string{"sh", "shell"}
+}
+
+func (s *Shell) Description() string {
+	return "Runs a command line in an empty temporary directory and returns its output. Pipes, redirections and variables are not supported. Allowed commands: " +
+		strings.Join(s.Commands, ", ") + "."
+}
+
+func (s *Shell) InputSchema() map[string]any {
+	return plugin.StringSchema("The command line, quoted as in a POSIX shell.")
+}
+
+// Allow restricts the shell to the admins, and to their own queries unless
+// Tool is set.
+func (s *Shell) Allow(ctx context.Context, byModel bool) bool {
+	return plugin.IsAdmin(ctx) && (s.Tool || !byModel)
+}
+
+func (s *Shell) Run(ctx context.Context, query string) (plugin.Result, error) {
+	args, err := SplitCommand(strings.Split(strings.TrimSpace(query), "\n")[0])
+	if err != nil {
+		return plugin.Result{}, err
+	}
+	if len(args) == 0 {
+		return plugin.Result{}, errors.New("empty command")
+	}
+	if !s.allowed(args[0]) {
+		return plugin.Result{}, fmt.Errorf("command %s is not allowed, the allowed commands are: %s",
+			args[0], strings.Join(s.Commands, ", "))
+	}
+	for _, arg := range args[1:] {
+		if escapes(arg) {
+			return plugin.Result{}, fmt.Errorf("argument %s is not allowed, only the paths inside the working directory are", arg)
+		}
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return plugin.Result{}, err
+	}
+
+	dir, err := os.MkdirTemp("", "shell-")
+	if err != nil {
+		return plugin.Result{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	output := &cappedBuffer{max: s.MaxOutput}
+	cmd := limitedCommand(path, args[1:], s.Timeout, s.Memory)
+	cmd.Dir = dir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	setProcAttr(cmd)
+	if err := cmd.Start(); err != nil {
+		return plugin.Result{}, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait() // reaps the process
+	}()
+	var timeout <-chan time.Time
+	if s.Timeout > 0 {
+		timer := time.NewTimer(s.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var status string
+	select {
+	case err = <-done:
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			status = fmt.Sprintf("[%v]", exitErr)
+		} else if err != nil {
+			return plugin.Result{}, err
+		}
+	case <-ctx.Done():
+		kill(cmd)
+		<-done
+		return plugin.Result{}, ctx.Err()
+	case <-timeout:
+		kill(cmd)
+		<-done
+		status = fmt.Sprintf("[killed after a timeout of %v]", s.Timeout)
+	}
+
+	text := strings.TrimSpace(strings.ToValidUTF8(output.buf.String(), ""))
+	if output.truncated {
+		text += fmt.Sprintf("\n... (output truncated to %d bytes)", s.MaxOutput)
+	}
+	if status != "" {
+		text = strings.TrimSpace(text + "\n" + status)
+	}
+	if text == "" {
+		text = "[no output]"
+	}
+	return plugin.Result{Text: text}, nil
+}
+
+// allowed reports whether a command is in the allowlist. Paths are not
+// allowed, so that only the commands found in PATH can run.
+func (s *Shell) allowed(command string) bool {
+	if strings.ContainsAny(command, `/\`) {
+		return false
+	}
+	for _, c := range s.Commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// escapes reports whether an argument may be a path outside the working
+// directory: an absolute path, a path from the home directory, or a path
+// with a ".." element, possibly as the value of an option (--file=/etc/x,
+// -f/etc/x). Short options can be clustered before their value (-mo/etc/x),
+// so every suffix of them is checked.
+func escapes(arg string) bool {
+	candidates := []string{arg}
+	if strings.HasPrefix(arg, "--") {
+		if _, value, ok := strings.Cut(arg, "="); ok {
+			candidates = append(candidates, value)
+		}
+	} else if strings.HasPrefix(arg, "-") {
+		for i := 1; i < len(arg); i++ {
+			candidates = append(candidates, arg[i:])
+		}
+	}
+	for _, c := range candidates {
+		if strings.HasPrefix(c, "/") || strings.HasPrefix(c, `\`) || strings.HasPrefix(c, "~") ||
+			filepath.IsAbs(c) || filepath.VolumeName(c) != "" {
+			return true
+		}
+		for _, elem := range strings.FieldsFunc(c, func(r rune) bool { return r == '/' || r == '\\' }) {
+			if elem == ".." {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SplitCommand splits a command line into words by the quoting rules of a
+// POSIX shell, without expansions. The operators of a shell are rejected,
+// since the command is not run by one.
+func SplitCommand(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	var inWord, escaped bool
+	var quote rune // the open quote, 0 if none
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			// in double quotes, a backslash only escapes a few characters
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", r) {
+				word.WriteRune('\\')
+			}
+			if r != '\n' { // line continuation
+				word.WriteRune(r)
+			}
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case strings.ContainsRune("|&;<>()`$", r):
+			return nil, fmt.Errorf("shell operator %q is not supported", r)
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed quote %c", quote)
+	} else if escaped {
+		return nil, errors.New("unfinished escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// cappedBuffer keeps the first max bytes written to it, or all of them if
+// max is not positive.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.buf.Len(); b.max > 0 && len(p) > n {
+		b.buf.Write(p[:n])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
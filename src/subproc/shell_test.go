@@ -0,0 +1,93 @@
+package subproc
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tztsai/openai-telegram/src/plugin"
+)
+
+func TestEscapes(t *testing.T) {
+	for arg, want := range map[string]bool{
+		"file.txt":           false,
+		"dir/file.txt":       false,
+		"-n5":                false,
+		"--lines=5":          false,
+		"1..2":               false,
+		"a..b/c":             false,
+		"/etc/passwd":        true,
+		"../secret":          true,
+		"dir/../../secret":   true,
+		`..\secret`:          true,
+		"~/.ssh/id_rsa":      true,
+		"--file=/etc/hosts":  true,
+		"--file=../x":        true,
+		"-f/etc/hosts":       true,
+		"-f..":               true,
+		"-mo/tmp/victim.txt": true,
+		"-hrf/etc/passwd":    true,
+		"-rf~/.ssh/id_rsa":   true,
+		"-xo../x":            true,
+		"-o=/etc/hosts":      true,
+		"..":                 true,
+	} {
+		if got := escapes(arg); got != want {
+			t.Errorf("escapes(%q) = %v, want %v", arg, got, want)
+		}
+	}
+}
+
+func TestShellRejectsPathsOutsideWorkingDir(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(secret, []byte("OPENAI_KEY=sk-secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewShell(nil, 5*time.Second, 0, false)
+	for _, query := range []string{
+		"cat " + secret,
+		"head -n 1 " + secret,
+		"grep -r KEY /",
+		"ls ..",
+		"tail ../../../" + strings.TrimPrefix(secret, "/"),
+		"grep --file=" + secret + " x",
+		"sort -mo" + secret + " x",
+		"grep -hrf" + secret + " .",
+	} {
+		res, err := s.Run(context.Background(), query)
+		if err == nil {
+			t.Errorf("%s: expected an error, got %q", query, res.Text)
+		} else if strings.Contains(res.Text, "sk-secret") {
+			t.Errorf("%s: leaked the secret", query)
+		}
+	}
+}
+
+func TestShellRunsAllowedCommands(t *testing.T) {
+	if _, err := exec.LookPath("echo"); err != nil {
+		t.Skip("echo not found")
+	}
+	s := NewShell(nil, 5*time.Second, 0, false)
+	res, err := s.Run(context.Background(), `echo "hello world" a/b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "hello world a/b" {
+		t.Errorf("output = %q", res.Text)
+	}
+	if _, err := s.Run(context.Background(), "rm -rf x"); err == nil {
+		t.Error("expected rm to be rejected")
+	}
+}
+
+func TestShellAllow(t *testing.T) {
+	ctx := plugin.WithAdmin(context.Background(), true)
+	if s := NewShell(nil, time.Second, 0, false); !s.Allow(ctx, false) || s.Allow(ctx, true) ||
+		s.Allow(context.Background(), false) {
+		t.Error("the shell must be restricted to the queries of the admins")
+	}
+}
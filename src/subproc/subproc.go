@@ -2,73 +2,250 @@ package subproc
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
-	"strings"
+	"sync"
+	"time"
 )
 
-const ETX = '\x03'
-const EOT = '\x04'
+// INTERRUPT_TIMEOUT is how long an interrupted process may take to finish
+// its output before being killed.
+const INTERRUPT_TIMEOUT = 5 * time.Second
 
+// MAX_FRAME_SIZE is the max size of a message from the process.
+const MAX_FRAME_SIZE = 64 << 20
+
+// MAX_HISTORY is the number of latest inputs and outputs kept.
+const MAX_HISTORY = 100
+
+// ErrTimeout is returned by Send when an input takes longer than Timeout.
+var ErrTimeout = errors.New("execution timed out")
+
+// Request is the message sent to the process for each input.
+type Request struct {
+	Code string `json:"code"`
+}
+
+// Result is the reply of the process to an input.
+type Result struct {
+	Stdout    string     `json:"stdout"`
+	Stderr    string     `json:"stderr"`
+	Value     string     `json:"value"` // repr of the last expression, if any
+	Exception *Exception `json:"exception"`
+	Time      float64    `json:"time"`   // execution time in seconds
+	Images    []string   `json:"images"` // paths of the figures shown
+	Files     []string   `json:"files"`  // paths of the files written
+}
+
+type Exception struct {
+	Type      string `json:"type"`
+	Message   string `json:"message"`
+	Traceback string `json:"traceback"`
+}
+
+type result struct {
+	res Result
+	err error
+}
+
+// Subproc is a process exchanging messages with Go through its stdin and
+// stdout. Each message is a JSON object preceded by its length, as a 32-bit
+// big-endian integer. The process replies to each Request with a Result.
 type Subproc struct {
-	Inputs  []string
-	Outputs []string
+	mu      sync.Mutex // serializes the inputs sent to the process
+	Inputs  []string   // latest MAX_HISTORY inputs
+	Outputs []Result   // latest MAX_HISTORY results
 	Cmd     *exec.Cmd
-	In      io.Writer
+	In      io.WriteCloser
 	Out     *bufio.Reader
+
+	Command string
+	Args    []string
+	Dir     string        // working directory, the current one if empty
+	Env     []string      // added to the environment of the process
+	Timeout time.Duration // max wall-clock time of an input, 0 for no limit
 }
 
 func Init(command string, args ...string) *Subproc {
-	cmd := exec.Command(command, args...)
+	p := &Subproc{Command: command, Args: args}
+	if err := p.Start(); err != nil {
+		log.Fatal(err)
+		return nil
+	}
+	return p
+}
+
+// Start starts the process, in its own process group so that the processes
+// it spawns are killed along with it.
+func (p *Subproc) Start() error {
+	cmd := exec.Command(p.Command, p.Args...)
+	cmd.Dir = p.Dir
+	cmd.Env = append(os.Environ(), p.Env...)
 	cmd.Stderr = os.Stderr
+	setProcAttr(cmd)
 
 	si, err := cmd.StdinPipe()
 	if err != nil {
-		log.Fatal(err)
-		return nil
+		return err
 	}
 	so, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Fatal(err)
-		return nil
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", p.Command, err)
 	}
 
-	err = cmd.Start()
-	if err != nil {
-		log.Fatal(err)
-		return nil
+	p.Cmd = cmd
+	p.In = si
+	p.Out = bufio.NewReader(so)
+	return nil
+}
+
+// Send sends an input to the process and returns its result. If ctx is done
+// before the result, the process is interrupted and ctx.Err() is returned.
+// If the input takes longer than Timeout, the process is restarted and
+// ErrTimeout is returned.
+func (p *Subproc) Send(ctx context.Context, input string) (Result, error) {
+	if len(input) == 0 {
+		return Result{}, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := writeFrame(p.In, Request{Code: input}); err != nil {
+		return Result{}, err
+	}
+	p.Inputs = keepLast(append(p.Inputs, input), MAX_HISTORY)
+
+	done := make(chan result, 1)
+	out := p.Out // replaced if the process is restarted
+	go func() {
+		var res Result
+		err := readFrame(out, &res)
+		done <- result{res, err}
+	}()
 
-	return &Subproc{
-		Inputs:  []string{},
-		Outputs: []string{},
-		Cmd:     cmd,
-		In:      si,
-		Out:     bufio.NewReader(so),
+	var timeout <-chan time.Time
+	if p.Timeout > 0 {
+		timer := time.NewTimer(p.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		if err := interrupt(p.Cmd); err == nil {
+			select {
+			case r = <-done: // result of the interrupted input
+				if r.err != nil {
+					log.Printf("Process %s was stopped by interrupt, restarting it: %v", p.Command, r.err)
+					p.restart(nil)
+				}
+				return Result{}, ctx.Err()
+			case <-time.After(INTERRUPT_TIMEOUT):
+			}
+		}
+		log.Printf("Process %s doesn't respond to interrupt, restarting it", p.Command)
+		p.restart(done)
+		return Result{}, ctx.Err()
+	case <-timeout:
+		log.Printf("Process %s timed out after %v, restarting it", p.Command, p.Timeout)
+		p.restart(done)
+		return Result{}, ErrTimeout
+	}
+	if r.err != nil {
+		// the process exited or broke the protocol
+		log.Printf("Couldn't read the result of %s, restarting it: %v", p.Command, r.err)
+		p.restart(nil)
+		return Result{}, r.err
+	}
+	p.Outputs = keepLast(append(p.Outputs, r.res), MAX_HISTORY)
+	return r.res, nil
 }
 
-func (p *Subproc) Send(input string) (string, error) {
-	if len(input) == 0 {
-		return "", nil
+// keepLast returns the last n elements of a slice, copied to a new array
+// when trimmed so that the dropped ones are released.
+func keepLast[T any](s []T, n int) []T {
+	if len(s) <= n {
+		return s
 	}
-	_, err := p.In.Write(append([]byte(input), ETX))
+	return append([]T(nil), s[len(s)-n:]...)
+}
+
+func writeFrame(w io.Writer, msg any) error {
+	data, err := json.Marshal(msg)
 	if err != nil {
-		return "", err
+		return err
 	}
-	p.Inputs = append(p.Inputs, input)
-	output, err := p.Out.ReadString(ETX)
-	output = strings.TrimSpace(output[:len(output)-1])
-	if err != nil {
-		return "", err
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	_, err = w.Write(append(frame, data...))
+	return err
+}
+
+func readFrame(r io.Reader, msg any) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MAX_FRAME_SIZE {
+		return fmt.Errorf("message of %d bytes exceeds the max size", size)
 	}
-	p.Outputs = append(p.Outputs, output)
-	return output, nil
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, msg)
 }
 
-func (p *Subproc) Close() {
-	p.In.Write([]byte{EOT})
+// restart kills the process and starts a new one. done receives the result
+// being read, which ends once the process is killed, or is nil if there is
+// none.
+func (p *Subproc) restart(done <-chan result) {
+	if err := kill(p.Cmd); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		log.Printf("Couldn't kill %s: %v", p.Command, err)
+	}
+	if done != nil {
+		select {
+		case <-done:
+		case <-time.After(INTERRUPT_TIMEOUT):
+			// a child process still holds the pipe, abandon the reader
+		}
+	}
 	p.Cmd.Wait()
+	if err := p.Start(); err != nil {
+		log.Printf("Couldn't restart %s: %v", p.Command, err)
+	}
+}
+
+// Close closes the stdin of the process, so that it exits once its current
+// input is done, and kills it if it doesn't.
+func (p *Subproc) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.In.Close()
+	exited := make(chan struct{})
+	go func() {
+		p.Cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(INTERRUPT_TIMEOUT):
+		kill(p.Cmd)
+		<-exited
+	}
 }
@@ -0,0 +1,108 @@
+package subproc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess is the process run by the tests of Subproc. It echoes
+// the inputs, sleeps on "sleep" and exits on "exit". Like Python, it is
+// stopped by SIGINT if it doesn't handle it.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("SUBPROC_HELPER") != "1" {
+		return
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		var req Request
+		if err := readFrame(in, &req); err != nil {
+			os.Exit(0)
+		}
+		switch req.Code {
+		case "sleep":
+			time.Sleep(time.Minute)
+		case "exit":
+			os.Exit(3)
+		}
+		writeFrame(os.Stdout, Result{Stdout: req.Code})
+	}
+}
+
+func startHelper(t *testing.T) *Subproc {
+	t.Helper()
+	p := &Subproc{
+		Command: os.Args[0],
+		Args:    []string{"-test.run=^TestHelperProcess$"},
+		Env:     []string{"SUBPROC_HELPER=1"},
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func send(t *testing.T, p *Subproc, input string) {
+	t.Helper()
+	res, err := p.Send(context.Background(), input)
+	if err != nil {
+		t.Fatalf("Send(%q): %v", input, err)
+	}
+	if res.Stdout != input {
+		t.Fatalf("Send(%q) = %q", input, res.Stdout)
+	}
+}
+
+func TestSubprocRestartsAfterInterrupt(t *testing.T) {
+	p := startHelper(t)
+	send(t, p, "before")
+	pid := p.Cmd.Process.Pid
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := p.Send(ctx, "sleep"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("interrupted Send returned %v", err)
+	}
+	if p.Cmd.Process.Pid == pid {
+		t.Error("the process killed by the interrupt was not restarted")
+	}
+	send(t, p, "after")
+}
+
+func TestSubprocRestartsAfterExit(t *testing.T) {
+	p := startHelper(t)
+	if _, err := p.Send(context.Background(), "exit"); err == nil {
+		t.Fatal("expected an error from a process that exited")
+	}
+	send(t, p, "after")
+}
+
+func TestSubprocRestartsAfterTimeout(t *testing.T) {
+	p := startHelper(t)
+	p.Timeout = 200 * time.Millisecond
+	if _, err := p.Send(context.Background(), "sleep"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Send returned %v, want ErrTimeout", err)
+	}
+	send(t, p, "after")
+}
+
+func TestSubprocKeepsLatestHistory(t *testing.T) {
+	p := startHelper(t)
+	for i := 0; i < MAX_HISTORY+20; i++ {
+		send(t, p, fmt.Sprint(i))
+	}
+	if len(p.Inputs) != MAX_HISTORY || len(p.Outputs) != MAX_HISTORY {
+		t.Fatalf("%d inputs and %d outputs kept, want %d", len(p.Inputs), len(p.Outputs), MAX_HISTORY)
+	}
+	if last := fmt.Sprint(MAX_HISTORY + 19); p.Inputs[MAX_HISTORY-1] != last || p.Outputs[MAX_HISTORY-1].Stdout != last {
+		t.Errorf("the last input is %q", p.Inputs[MAX_HISTORY-1])
+	}
+	if p.Inputs[0] != "20" {
+		t.Errorf("the first input kept is %q, want 20", p.Inputs[0])
+	}
+}
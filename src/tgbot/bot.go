@@ -1,20 +1,32 @@
 package tgbot
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"math"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"strings"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/tztsai/openai-telegram/src/markdown"
+	"github.com/tztsai/openai-telegram/src/sse"
 )
 
+const MAX_LENGTH = 4096 // max length of a message in UTF-16 code units
+
+const MAX_ALBUM = 10 // max number of photos of a media group
+
 type Bot struct {
+	ID           int64
 	Username     string
 	api          *tgbotapi.BotAPI
 	editInterval time.Duration
+	server       *http.Server // receiving the updates sent to the webhook
 }
 
 func New(token string, editInterval time.Duration) (*Bot, error) {
@@ -30,6 +42,7 @@ func New(token string, editInterval time.Duration) (*Bot, error) {
 		return nil, err
 	}
 	return &Bot{
+		ID:           api.Self.ID,
 		Username:     api.Self.UserName,
 		api:          api,
 		editInterval: editInterval,
@@ -44,98 +57,286 @@ func (b *Bot) GetUpdatesChan() tgbotapi.UpdatesChannel {
 
 func (b *Bot) Stop() {
 	b.api.StopReceivingUpdates()
+	b.stopServer()
 }
 
-func (b *Bot) Send(chatID int64, replyTo int, text string) (tgbotapi.Message, error) {
-	// text = strings.Replace(text, "{", "\\{", -1)
-	// text = strings.Replace(text, "}", "\\}", -1)
-	lines := strings.Split(text, "\n")
-	maxlen := 4096 // max length of a message
-	block_closed := true
-	content := ""
+// Send sends a text to the chat, split into several messages if too long.
+// The buttons, if any, are attached to the last message.
+func (b *Bot) Send(chatID int64, replyTo int, text string, buttons ...tgbotapi.InlineKeyboardButton) (tgbotapi.Message, error) {
 	var msg tgbotapi.Message
-
-	for i := 0; i <= len(lines); i++ {
-		var line string
-		if i < len(lines) {
-			line = lines[i]
-		} else {
-			line = ""
+	var err error
+	parts := markdown.SplitRendered(text, MAX_LENGTH)
+	for i, part := range parts {
+		c := tgbotapi.NewMessage(chatID, markdown.ToHTML(part))
+		c.ParseMode = tgbotapi.ModeHTML
+		c.ReplyToMessageID = replyTo
+		if i == len(parts)-1 && len(buttons) > 0 {
+			c.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(buttons)
 		}
-
-		if len(line) > maxlen {
-			line = line[:maxlen-3] + "..."
-			log.Println("Truncated line")
+		msg, err = b.api.Send(c)
+		if isEntityError(err) || isTooLong(err) {
+			log.Printf("Couldn't send message as HTML, sending it as plain text: %v", err)
+			c.Text, c.ParseMode = part, ""
+			msg, err = b.api.Send(c)
 		}
-
-		if i == len(lines) || len(content)+len(line) > maxlen {
-			content, block_closed = markdown.EnsureFormatting(content, block_closed)
-			c := tgbotapi.NewMessage(chatID, content)
-			// c.ParseMode = "Markdown"
-			c.ReplyToMessageID = replyTo
-			msg, err := b.api.Send(c)
-			content = line
-			if err != nil {
-				return msg, err
-			}
-		} else {
-			content += "\n" + line
+		if err != nil {
+			return msg, err
 		}
 	}
 	return msg, nil
 }
 
+// Edit replaces the text of a message sent by the bot, along with its
+// buttons, which are removed if none is given.
+func (b *Bot) Edit(chatID int64, messageID int, text string, buttons ...tgbotapi.InlineKeyboardButton) error {
+	c := tgbotapi.NewEditMessageText(chatID, messageID, markdown.ToHTML(text))
+	c.ParseMode = tgbotapi.ModeHTML
+	if len(buttons) > 0 {
+		markup := tgbotapi.NewInlineKeyboardMarkup(buttons)
+		c.ReplyMarkup = &markup
+	}
+	_, err := b.api.Send(c)
+	if isEntityError(err) || isTooLong(err) {
+		log.Printf("Couldn't edit message as HTML, editing it as plain text: %v", err)
+		c.Text, c.ParseMode = text, ""
+		_, err = b.api.Send(c)
+	}
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		return nil
+	}
+	return err
+}
+
+// SetButtons replaces the buttons of a message sent by the bot, which are
+// removed if none is given.
+func (b *Bot) SetButtons(chatID int64, messageID int, buttons ...tgbotapi.InlineKeyboardButton) {
+	markup := tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}
+	if len(buttons) > 0 {
+		markup = tgbotapi.NewInlineKeyboardMarkup(buttons)
+	}
+	_, err := b.api.Request(tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, markup))
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Printf("Couldn't set buttons: %v", err)
+	}
+}
+
+// Delete deletes messages of a chat.
+func (b *Bot) Delete(chatID int64, messageIDs ...int) {
+	for _, id := range messageIDs {
+		if _, err := b.api.Request(tgbotapi.NewDeleteMessage(chatID, id)); err != nil {
+			log.Printf("Couldn't delete message: %v", err)
+		}
+	}
+}
+
+// isEntityError reports whether Telegram rejected the formatting of a text.
+func isEntityError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "can't parse entities")
+}
+
+// isTooLong reports whether Telegram rejected a text longer than MAX_LENGTH
+// once rendered.
+func isTooLong(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "message is too long")
+}
+
+// AnswerCallback notifies the user that a button press has been handled.
+func (b *Bot) AnswerCallback(queryID string, text string) {
+	if _, err := b.api.Request(tgbotapi.NewCallback(queryID, text)); err != nil {
+		log.Printf("Couldn't answer callback query: %v", err)
+	}
+}
+
 func (b *Bot) SendTyping(chatID int64) {
 	if _, err := b.api.Request(tgbotapi.NewChatAction(chatID, "typing")); err != nil {
 		log.Printf("Couldn't send typing action: %v", err)
 	}
 }
 
-func (b *Bot) SendAsLiveOutput(chatID int64, replyTo int, feed chan string) {
-	var queue []string
-	var lastEditTime time.Time
-	var lastTypeTime time.Time
-	var done = false
+// SendAsLiveOutput sends the chunks of feed to the chat. Appended chunks are
+// shown by editing the last message in place, at most once per editInterval.
+// The buttons, if any, are attached to the message being written and removed
+// once it is complete. It returns the IDs of the text messages sent.
+func (b *Bot) SendAsLiveOutput(chatID int64, replyTo int, feed chan sse.Chunk, buttons ...tgbotapi.InlineKeyboardButton) []int {
+	var (
+		sent         []int  // IDs of the messages sent
+		text         string // text of the message being written
+		shown        string // text of the message as currently displayed
+		messageID    int    // ID of the message being written, 0 if not sent yet
+		hasButtons   bool   // whether the buttons are displayed
+		lastEditTime time.Time
+		lastTypeTime time.Time
+	)
+
+	// flush displays the text; complete is true if no more text is appended
+	flush := func(complete bool) {
+		for len(text) > 0 && (text != shown || complete && hasButtons) {
+			display, rest := markdown.CutRendered(text, MAX_LENGTH)
+			live := buttons
+			if complete || rest != "" { // the message is full, continue in a new one
+				live = nil
+			}
+
+			if strings.TrimSpace(display) == "" {
+				if rest == "" {
+					return // nothing to show yet
+				}
+				text = rest
+				continue
+			} else if messageID == 0 {
+				message, err := b.Send(chatID, replyTo, display, live...)
+				if err != nil {
+					log.Printf("Couldn't send message: %v", err)
+					return
+				}
+				messageID = message.MessageID
+				replyTo = message.MessageID
+				sent = append(sent, messageID)
+			} else if err := b.Edit(chatID, messageID, display, live...); err != nil {
+				log.Printf("Couldn't edit message: %v", err)
+				return
+			}
+			lastEditTime = time.Now()
+			hasButtons = len(live) > 0
+
+			if rest != "" {
+				text, shown, messageID = rest, "", 0
+			} else {
+				shown = text
+			}
+		}
+	}
+
+	interval := b.editInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	for !done || len(queue) > 0 {
+	for {
 		if time.Since(lastTypeTime) > 10*time.Second {
 			b.SendTyping(chatID)
 			lastTypeTime = time.Now()
 		}
 
-		if !done {
-			select {
-			case response, ok := <-feed:
-				if !ok {
-					done = true
-				} else {
-					queue = append(queue, response)
-				}
+		select {
+		case chunk, ok := <-feed:
+			if !ok {
+				flush(true)
+				return sent
 			}
+			if !chunk.Append {
+				flush(true)
+				text, shown, messageID, hasButtons = "", "", 0, false
+			}
+			if chunk.Photo != "" {
+				b.SendPhoto(chatID, chunk.Photo)
+			} else if len(chunk.Album) > 0 {
+				b.SendAlbum(chatID, chunk.Album)
+			} else if chunk.Document != "" {
+				b.SendDocument(chatID, chunk.Document)
+			}
+			text += chunk.Text
+			if time.Since(lastEditTime) >= b.editInterval {
+				flush(false)
+			}
+		case <-ticker.C:
+			flush(false)
 		}
+	}
+}
 
-		if len(queue) == 0 || time.Since(lastEditTime) < b.editInterval {
-			continue
+// Download downloads a file sent to the bot into a temporary file, whose
+// path is returned. Files larger than 20 MB can't be downloaded by bots.
+func (b *Bot) Download(fileID string) (string, error) {
+	return b.DownloadTo(fileID, "")
+}
+
+// DownloadTo downloads a file sent to the bot into a new file of a
+// directory, or of the temporary directory if empty, and returns its path.
+func (b *Bot) DownloadTo(fileID string, dir string) (string, error) {
+	link, err := b.api.GetFileDirectURL(fileID)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Get(link)
+	if err != nil {
+		// the error would reveal the token in the link
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
 		}
+		return "", fmt.Errorf("couldn't download file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("couldn't download file: %s", resp.Status)
+	}
 
-		message, err := b.Send(chatID, replyTo, queue[0])
+	file, err := os.CreateTemp(dir, "telegram-*"+path.Ext(link))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
 
-		if err != nil {
-			log.Fatalf("Couldn't send message: %v", err)
-		} else {
-			l := math.Min(30, float64(len(queue[0])))
-			log.Printf("Sent message: %s...", queue[0][:int(l)])
-			queue = queue[1:]
-			lastEditTime = time.Now()
-			replyTo = message.MessageID
-		}
+// photoFile returns the file of a photo given by its path or URL.
+func photoFile(photo string) tgbotapi.RequestFileData {
+	if strings.HasPrefix(photo, "https://") || strings.HasPrefix(photo, "http://") {
+		return tgbotapi.FileURL(photo)
 	}
+	return tgbotapi.FilePath(photo)
 }
 
-func (b *Bot) SendPhoto(chatID int64, photoPath string) {
-	path := tgbotapi.FilePath(photoPath)
-	photo := tgbotapi.NewPhoto(chatID, path)
-	if _, err := b.api.Send(photo); err != nil {
+// SendPhoto sends a photo given by its path or URL.
+func (b *Bot) SendPhoto(chatID int64, photo string) {
+	if _, err := b.api.Send(tgbotapi.NewPhoto(chatID, photoFile(photo))); err != nil {
 		log.Printf("Couldn't send photo: %v", err)
 	}
 }
+
+// SendAlbum sends photos given by their paths or URLs as media groups of at
+// most MAX_ALBUM photos.
+func (b *Bot) SendAlbum(chatID int64, photos []string) {
+	for len(photos) > 0 {
+		n := len(photos)
+		if n > MAX_ALBUM {
+			n = MAX_ALBUM
+		}
+		if n == 1 {
+			b.SendPhoto(chatID, photos[0])
+			return
+		}
+		var media []interface{}
+		for _, photo := range photos[:n] {
+			media = append(media, tgbotapi.NewInputMediaPhoto(photoFile(photo)))
+		}
+		if _, err := b.api.SendMediaGroup(tgbotapi.NewMediaGroup(chatID, media)); err != nil {
+			log.Printf("Couldn't send album: %v", err)
+		}
+		photos = photos[n:]
+	}
+}
+
+func (b *Bot) SendDocument(chatID int64, filePath string) {
+	path := tgbotapi.FilePath(filePath)
+	document := tgbotapi.NewDocument(chatID, path)
+	if _, err := b.api.Send(document); err != nil {
+		log.Printf("Couldn't send document: %v", err)
+	}
+}
+
+// SendVoice sends an OGG/Opus file to the chat as a voice note.
+func (b *Bot) SendVoice(chatID int64, replyTo int, filePath string) {
+	voice := tgbotapi.NewVoice(chatID, tgbotapi.FilePath(filePath))
+	voice.ReplyToMessageID = replyTo
+	if _, err := b.api.Send(voice); err != nil {
+		log.Printf("Couldn't send voice note: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package tgbot
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const SECRET_HEADER = "X-Telegram-Bot-Api-Secret-Token"
+
+const MAX_UPDATE_SIZE = 1 << 20 // max size of the body of a webhook request
+
+// WebhookConfig configures the reception of updates through a webhook. An
+// empty URL means long polling.
+type WebhookConfig struct {
+	URL    string // public URL of the webhook, given to Telegram
+	Listen string // address of the HTTP server
+	Secret string // secret token sent by Telegram in each request, random if empty
+	Cert   string // path of the certificate of the server, uploaded to Telegram
+	Key    string // path of the private key of the server
+}
+
+// GetUpdates returns the updates received through the webhook configured by
+// cfg, or by long polling if there is none or it couldn't be set up.
+func (b *Bot) GetUpdates(cfg WebhookConfig) tgbotapi.UpdatesChannel {
+	if cfg.URL != "" {
+		updates, err := b.ListenForWebhook(cfg)
+		if err == nil {
+			return updates
+		}
+		log.Printf("Couldn't set up webhook, falling back to polling: %v", err)
+	}
+	// getUpdates is rejected while a webhook is set
+	if _, err := b.api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		log.Printf("Couldn't delete webhook: %v", err)
+	}
+	return b.GetUpdatesChan()
+}
+
+// ListenForWebhook starts an HTTP server receiving the updates sent to the
+// webhook, then registers the webhook with Telegram. The server serves
+// HTTPS if a certificate and key are given, and plain HTTP otherwise, which
+// is meant to run behind a reverse proxy terminating TLS.
+func (b *Bot) ListenForWebhook(cfg WebhookConfig) (tgbotapi.UpdatesChannel, error) {
+	link, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Secret == "" {
+		if cfg.Secret, err = randomSecret(); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Cert != "" && cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	updates := make(chan tgbotapi.Update, b.api.Buffer)
+	path := link.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, webhookHandler(cfg.Secret, updates))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Webhook server stopped: %v", err)
+		}
+	}()
+
+	if err := b.setWebhook(link, cfg); err != nil {
+		server.Close()
+		return nil, err
+	}
+	b.server = server
+	log.Printf("Receiving updates at %s on %s", cfg.URL, ln.Addr())
+	return updates, nil
+}
+
+// setWebhook asks Telegram to send the updates to link with the secret of
+// cfg, uploading its certificate if any so that a self-signed one is
+// trusted.
+func (b *Bot) setWebhook(link *url.URL, cfg WebhookConfig) error {
+	params := tgbotapi.Params{
+		"url":          link.String(),
+		"secret_token": cfg.Secret,
+	}
+	if cfg.Cert == "" {
+		_, err := b.api.MakeRequest("setWebhook", params)
+		return err
+	}
+	_, err := b.api.UploadFiles("setWebhook", params, []tgbotapi.RequestFile{{
+		Name: "certificate",
+		Data: tgbotapi.FilePath(cfg.Cert),
+	}})
+	return err
+}
+
+// webhookHandler queues the updates of the requests bearing the secret.
+func webhookHandler(secret string, updates chan<- tgbotapi.Update) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.Header.Get(SECRET_HEADER)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			log.Printf("Rejected webhook request from %s with a wrong secret token", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var update tgbotapi.Update
+		body := http.MaxBytesReader(w, r.Body, MAX_UPDATE_SIZE)
+		if err := json.NewDecoder(body).Decode(&update); err != nil {
+			log.Printf("Couldn't decode webhook update: %v", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		select {
+		case updates <- update:
+		case <-r.Context().Done():
+			// Telegram sends the update again later
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// randomSecret returns a random token made of the characters allowed by
+// Telegram.
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// stopServer stops the webhook server, if any, waiting a few seconds for
+// the requests in progress.
+func (b *Bot) stopServer() {
+	if b.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.server.Shutdown(ctx); err != nil {
+		log.Printf("Couldn't stop webhook server: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package tokenizer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const CL100K_BASE = "cl100k_base"
+const O200K_BASE = "o200k_base"
+
+// The vocabularies of OpenAI's tiktoken, gzipped.
+//
+//go:embed assets/*.tiktoken.gz
+var assets embed.FS
+
+// Go's \s only matches ASCII whitespace, unlike the Unicode \s of tiktoken.
+const ws = `\s\x0B\x{85}\p{Z}`
+
+// The split patterns of tiktoken without the `\s+(?!\S)` alternative, which
+// RE2 can't express and is emulated by Encoding.split.
+var PATTERNS = map[string]string{
+	CL100K_BASE: `(?i:'s|'t|'re|'ve|'m|'ll|'d)` +
+		`|[^\r\n\p{L}\p{N}]?\p{L}+` +
+		`|\p{N}{1,3}` +
+		`| ?[^` + ws + `\p{L}\p{N}]+[\r\n]*` +
+		`|[` + ws + `]*[\r\n]+` +
+		`|[` + ws + `]+`,
+	O200K_BASE: `[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}` +
+		`| ?[^` + ws + `\p{L}\p{N}]+[\r\n/]*` +
+		`|[` + ws + `]*[\r\n]+` +
+		`|[` + ws + `]+`,
+}
+
+var WHITESPACE = regexp.MustCompile(`^[` + ws + `]+$`)
+
+// Encoding is a byte-level BPE tokenizer compatible with tiktoken.
+type Encoding struct {
+	Name    string
+	ranks   map[string]int
+	pattern *regexp.Regexp
+
+	decodeOnce sync.Once
+	tokens     map[int]string // inverse of ranks, built on first decode
+}
+
+var (
+	mu        sync.Mutex
+	encodings = make(map[string]*Encoding)
+)
+
+// Get returns an encoding by name, loading its vocabulary on first use.
+func Get(name string) (*Encoding, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if enc, ok := encodings[name]; ok {
+		return enc, nil
+	}
+	pattern, ok := PATTERNS[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding: %s", name)
+	}
+	ranks, err := loadRanks(name)
+	if err != nil {
+		return nil, err
+	}
+	enc := &Encoding{
+		Name:    name,
+		ranks:   ranks,
+		pattern: regexp.MustCompile(pattern),
+	}
+	encodings[name] = enc
+	return enc, nil
+}
+
+func loadRanks(name string) (map[string]int, error) {
+	f, err := assets.Open("assets/" + name + ".tiktoken.gz")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		token, rank, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		bs, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token in %s: %v", name, err)
+		}
+		r, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rank in %s: %v", name, err)
+		}
+		ranks[string(bs)] = r
+	}
+	return ranks, scanner.Err()
+}
+
+// Encode returns the tokens of a text. Special tokens are encoded as
+// ordinary text.
+func (e *Encoding) Encode(text string) []int {
+	var tokens []int
+	for _, piece := range e.split(text) {
+		if rank, ok := e.ranks[piece]; ok {
+			tokens = append(tokens, rank)
+		} else {
+			tokens = append(tokens, e.bytePairEncode([]byte(piece))...)
+		}
+	}
+	return tokens
+}
+
+func (e *Encoding) Count(text string) int {
+	return len(e.Encode(text))
+}
+
+// Decode returns the text of tokens. Unknown tokens are skipped.
+func (e *Encoding) Decode(tokens []int) string {
+	e.decodeOnce.Do(func() {
+		e.tokens = make(map[int]string, len(e.ranks))
+		for token, rank := range e.ranks {
+			e.tokens[rank] = token
+		}
+	})
+	var b strings.Builder
+	for _, t := range tokens {
+		b.WriteString(e.tokens[t])
+	}
+	return b.String()
+}
+
+// split splits a text into pieces by the pattern of the encoding. A run of
+// whitespace followed by a non-space leaves its last character to the next
+// piece, as `\s+(?!\S)` does in tiktoken.
+func (e *Encoding) split(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		loc := e.pattern.FindStringIndex(text)
+		if loc == nil {
+			break
+		}
+		start, end := loc[0], loc[1]
+		if end == start {
+			end += 1 // avoid an infinite loop, never happens in practice
+		}
+		piece := text[start:end]
+		if end < len(text) && WHITESPACE.MatchString(piece) && !strings.ContainsAny(piece, "\r\n") {
+			if _, size := utf8.DecodeLastRuneInString(piece); size < len(piece) {
+				end -= size
+				piece = piece[:len(piece)-size]
+			}
+		}
+		pieces = append(pieces, piece)
+		text = text[end:]
+	}
+	return pieces
+}
+
+// bytePairEncode repeatedly merges the adjacent parts of a piece with the
+// lowest rank.
+func (e *Encoding) bytePairEncode(piece []byte) []int {
+	// bounds[i] is the start of the i-th part, the last one is len(piece)
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+
+	for len(bounds) > 2 {
+		best, bestRank := -1, 0
+		for i := 0; i+2 < len(bounds); i++ {
+			rank, ok := e.ranks[string(piece[bounds[i]:bounds[i+2]])]
+			if ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+
+	tokens := make([]int, len(bounds)-1)
+	for i := range tokens {
+		tokens[i] = e.ranks[string(piece[bounds[i]:bounds[i+1]])]
+	}
+	return tokens
+}
@@ -0,0 +1,59 @@
+package tokenizer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+		tokens   []int
+	}{
+		{CL100K_BASE, "hello world", []int{15339, 1917}},
+		{CL100K_BASE, "Hello, world!", []int{9906, 11, 1917, 0}},
+		{CL100K_BASE, "", nil},
+		{O200K_BASE, "hello world", []int{24912, 2375}},
+	}
+	for _, tt := range tests {
+		enc, err := Get(tt.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokens := enc.Encode(tt.text); !reflect.DeepEqual(tokens, tt.tokens) {
+			t.Errorf("%s: Encode(%q) = %v, want %v", tt.encoding, tt.text, tokens, tt.tokens)
+		}
+		if n := enc.Count(tt.text); n != len(tt.tokens) {
+			t.Errorf("%s: Count(%q) = %d, want %d", tt.encoding, tt.text, n, len(tt.tokens))
+		}
+	}
+}
+
+func TestDecodeRoundTrip(t *testing.T) {
+	texts := []string{
+		"hello world",
+		"  leading spaces and trailing ones   ",
+		"line one\r\nline two\n\n\tindented",
+		"naïve café, 東京, Привет, 🤖🎉",
+		"func main() {\n\tfmt.Println(\"x := 1_000_000\")\n}\n",
+		"I'm sure they'll say it's fine, but we'd better check.",
+	}
+	for _, name := range []string{CL100K_BASE, O200K_BASE} {
+		enc, err := Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, text := range texts {
+			if decoded := enc.Decode(enc.Encode(text)); decoded != text {
+				t.Errorf("%s: %q decoded as %q", name, text, decoded)
+			}
+		}
+	}
+}
+
+func TestGetUnknown(t *testing.T) {
+	if _, err := Get("p50k_base"); err == nil {
+		t.Error("unknown encoding loaded")
+	}
+}
@@ -0,0 +1,75 @@
+package web
+
+import (
+	"context"
+	"strings"
+
+	"github.com/tztsai/openai-telegram/src/plugin"
+	"github.com/tztsai/openai-telegram/src/sse"
+)
+
+const USER_AGENT = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0.0.0 Safari/537.36"
+
+const MAX_LENGTH = 6400
+
+type API struct {
+	MaxLength int
+}
+
+func Init() *API {
+	return &API{
+		MaxLength: MAX_LENGTH,
+	}
+}
+
+func (c *API) InitClient(url string) sse.Client {
+	client := sse.Init(strings.TrimSpace(url))
+	client.Headers = map[string]string{
+		"User-Agent": USER_AGENT,
+	}
+	return client
+}
+
+// Send fetches a webpage and returns its text content.
+func (c *API) Send(ctx context.Context, url string) (string, error) {
+	client := c.InitClient(url)
+	err := client.Connect(ctx, "GET", map[string]string{}, nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "404 Not Found") {
+			return "404 Not Found", nil
+		}
+		return "", err
+	}
+	chunk := <-client.ExtractHtml(c.MaxLength)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return chunk.Text, nil
+}
+
+func (c *API) Name() string {
+	return "Web"
+}
+
+func (c *API) Aliases() []string {
+	return []string{"web"}
+}
+
+func (c *API) Description() string {
+	return "Sends a HTTP request and returns the text content of the response. The query should be a URL. The plugin has internet access and can fetch webpage contents."
+}
+
+func (c *API) InputSchema() map[string]any {
+	return plugin.StringSchema("The URL of the webpage.")
+}
+
+func (c *API) Run(ctx context.Context, query string) (plugin.Result, error) {
+	ans, err := c.Send(ctx, strings.Split(query, "\n")[0])
+	if err != nil {
+		return plugin.Result{}, err
+	}
+	if ans == "" {
+		return plugin.Result{}, plugin.ErrNoResult
+	}
+	return plugin.Result{Text: ans}, nil
+}
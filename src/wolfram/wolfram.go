@@ -1,11 +1,13 @@
 package wolfram
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
 
 	"github.com/tztsai/openai-telegram/src/config"
+	"github.com/tztsai/openai-telegram/src/plugin"
 	"github.com/tztsai/openai-telegram/src/sse"
 )
 
@@ -36,7 +38,7 @@ func (c *API) InitClient() sse.Client {
 	return client
 }
 
-func (c *API) Send(query string) (string, error) {
+func (c *API) Send(ctx context.Context, query string) (string, error) {
 	client := c.InitClient()
 	params := map[string]string{
 		"input":  query,
@@ -45,12 +47,16 @@ func (c *API) Send(query string) (string, error) {
 		"appid":  c.AppID,
 	}
 
-	err := client.Connect("GET", params, nil)
+	err := client.Connect(ctx, "GET", params, nil)
 	if err != nil {
 		return "", err
 	}
 
-	chunk, ok := <-client.EventChannel
+	event, ok := <-client.EventChannel
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	chunk := []byte(event.Data)
 	if len(chunk) == 0 || !ok {
 		return "", fmt.Errorf("no response from WolframAlpha")
 	}
@@ -62,6 +68,33 @@ func (c *API) Send(query string) (string, error) {
 	return ExtractResponse(res), nil
 }
 
+func (c *API) Name() string {
+	return "Wolfram"
+}
+
+func (c *API) Aliases() []string {
+	return []string{"wolf", "wolfram"}
+}
+
+func (c *API) Description() string {
+	return "Queries the curated knowledgebase and scientific computation of Wolfram Alpha. The query must be interpretable by Wolfram Alpha, in Wolfram Language if necessary."
+}
+
+func (c *API) InputSchema() map[string]any {
+	return plugin.StringSchema("A query interpretable by Wolfram Alpha.")
+}
+
+func (c *API) Run(ctx context.Context, query string) (plugin.Result, error) {
+	ans, err := c.Send(ctx, strings.Split(query, "\n")[0])
+	if err != nil {
+		return plugin.Result{}, err
+	}
+	if ans == "" {
+		return plugin.Result{}, plugin.ErrNoResult
+	}
+	return plugin.Result{Text: ans}, nil
+}
+
 func ExtractResponse(resp map[string]map[string]any) string {
 	res := resp["queryresult"]
 	ans, ok := res["pods"]
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/tztsai/openai-telegram/src/markdown"
+)
+
+const (
+	TRANSCRIPTION_TIMEOUT = 2 * time.Minute // of a voice message
+	SYNTHESIS_TIMEOUT     = 2 * time.Minute // of a spoken reply
+)
+
+// isVoice reports whether a message is a voice note or an audio file.
+func isVoice(m *tgbotapi.Message) bool {
+	return m.Voice != nil || m.Audio != nil
+}
+
+// transcribe downloads the voice note or audio file of a message and
+// converts it to text.
+func (h *Handler) transcribe(m *tgbotapi.Message) (string, error) {
+	fileID := ""
+	if m.Voice != nil {
+		fileID = m.Voice.FileID
+	} else {
+		fileID = m.Audio.FileID
+	}
+	path, err := h.bot.Download(fileID)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), TRANSCRIPTION_TIMEOUT)
+	defer cancel()
+	text, err := h.stt.Transcribe(ctx, path)
+	if err != nil {
+		return "", err
+	} else if text == "" {
+		return "", errors.New("no speech recognized")
+	}
+	return text, nil
+}
+
+// quote formats a text as a Markdown block quote.
+func quote(text string) string {
+	return "> " + strings.ReplaceAll(text, "\n", "\n> ")
+}
+
+// speak sends the last answer of a conversation as a voice note, replying to
+// its last message, if the voice mode of the conversation is on. The code
+// blocks and URLs of the answer are not read.
+func (h *Handler) speak(convoID int64, a answer) {
+	convo := h.gpt.GetConversation(convoID)
+	if !convo.Voice || len(a.messages) == 0 || len(convo.Messages) == 0 {
+		return
+	}
+	last := convo.Messages[len(convo.Messages)-1]
+	if last.Role != "assistant" {
+		return
+	}
+	text := markdown.ToSpeech(last.Content)
+	if text == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SYNTHESIS_TIMEOUT)
+	defer cancel()
+	path, err := h.tts.Synthesize(ctx, text)
+	if err != nil {
+		log.Printf("Couldn't synthesize speech: %v", err)
+		return
+	}
+	defer os.Remove(path)
+	h.bot.SendVoice(a.chatID, a.messages[len(a.messages)-1], path)
+}